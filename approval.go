@@ -0,0 +1,184 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ApprovalDecision is the decision taken on an approval stage
+type ApprovalDecision string
+
+// Decisions of approval stages
+const (
+	Approved ApprovalDecision = "approved"
+	Rejected ApprovalDecision = "rejected"
+)
+
+func (d ApprovalDecision) valid() bool {
+	return d == Approved || d == Rejected
+}
+
+// ErrRejected is the error of an approval stage whose approval was rejected
+var ErrRejected = errors.New("approval rejected")
+
+// Approval is the decision taken on an approval stage, stored in Result.KeyVal under ApprovalKey(stage)
+type Approval struct {
+	Decision ApprovalDecision `json:"decision"`
+	Approver string           `json:"approver"`
+	Comment  string           `json:"comment"`
+	Time     time.Time        `json:"time"`
+	// TimedOut is set if the default action was taken after the approval timeout
+	TimedOut bool `json:"timedOut"`
+}
+
+// ApprovalKey is the key of the Approval of the stage in Result.KeyVal
+func ApprovalKey(stage string) string {
+	return "approval." + stage
+}
+
+// approvalGate receives the decision for the running approval step of a stage
+type approvalGate struct {
+	decision      chan Approval
+	defaultAction ApprovalDecision
+	sync.Mutex
+}
+
+// NewApprovalStage returns a stage which blocks the pipeline until its approval is approved or rejected with
+// Approve or Reject. If timeout isn't zero, defaultAction, Approved or Rejected if empty, is taken when no
+// decision is taken within timeout. Any other defaultAction is reported by Validate and fails the stage.
+// A rejected approval fails the stage with ErrRejected. Data and KeyVal are passed on to the next stage
+func NewApprovalStage(name string, timeout time.Duration, defaultAction ApprovalDecision) *Stage {
+	if defaultAction == "" {
+		defaultAction = Rejected
+	}
+
+	gate := &approvalGate{defaultAction: defaultAction}
+	st := NewStage(name, false, false)
+	st.approval = gate
+	st.AddStep(NewStep("approval", func(ctx context.Context, request *Request) *Result {
+		return gate.wait(ctx, st.Name, request, timeout)
+	}))
+	return st
+}
+
+func (g *approvalGate) wait(ctx context.Context, stage string, request *Request, timeout time.Duration) *Result {
+	defaultAction := g.defaultAction
+	if !defaultAction.valid() {
+		return &Result{Error: fmt.Errorf("unknown approval default action %q", defaultAction)}
+	}
+
+	decision := make(chan Approval, 1)
+	g.Lock()
+	if g.decision != nil {
+		g.Unlock()
+		return &Result{Error: fmt.Errorf("stage %s is already waiting for approval", stage)}
+	}
+	g.decision = decision
+	g.Unlock()
+
+	defer func() {
+		g.Lock()
+		g.decision = nil
+		g.Unlock()
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+		StepStatus(ctx, fmt.Sprintf("waiting for approval, %s in %s", defaultAction, timeout))
+	} else {
+		StepStatus(ctx, "waiting for approval")
+	}
+
+	var approval Approval
+	select {
+	case approval = <-decision:
+	case <-expired:
+		approval = Approval{Decision: defaultAction, Time: time.Now(), TimedOut: true}
+	case <-ctx.Done():
+		return &Result{Error: ctx.Err()}
+	}
+
+	if approval.TimedOut {
+		StepStatus(ctx, fmt.Sprintf("%s after approval timeout", approval.Decision))
+	} else {
+		StepStatus(ctx, fmt.Sprintf("%s by %s: %s", approval.Decision, approval.Approver, approval.Comment))
+	}
+
+	kv := make(map[string]interface{}, len(request.KeyVal)+1)
+	for k, v := range request.KeyVal {
+		kv[k] = v
+	}
+	kv[ApprovalKey(stage)] = approval
+
+	result := &Result{Data: request.Data, KeyVal: kv}
+	if approval.Decision == Rejected {
+		result.Error = fmt.Errorf("%w by %s: %s", ErrRejected, approval.Approver, approval.Comment)
+		if approval.TimedOut {
+			result.Error = fmt.Errorf("%w after approval timeout", ErrRejected)
+		}
+	}
+	return result
+}
+
+func (g *approvalGate) decide(stage string, approval Approval) error {
+	g.Lock()
+	defer g.Unlock()
+	if g.decision == nil {
+		return fmt.Errorf("stage %s is not waiting for approval", stage)
+	}
+
+	approval.Time = time.Now()
+	g.decision <- approval
+	g.decision = nil
+	return nil
+}
+
+// Approve the approval stage while it is waiting for a decision
+func (st *Stage) Approve(approver string, comment string) error {
+	return st.decide(Approval{Decision: Approved, Approver: approver, Comment: comment})
+}
+
+// Reject the approval stage while it is waiting for a decision
+func (st *Stage) Reject(approver string, comment string) error {
+	return st.decide(Approval{Decision: Rejected, Approver: approver, Comment: comment})
+}
+
+func (st *Stage) decide(approval Approval) error {
+	if st.approval == nil {
+		return fmt.Errorf("stage %s is not an approval stage", st.Name)
+	}
+	return st.approval.decide(st.Name, approval)
+}
+
+// Approve the approval stage of the pipeline while it is waiting for a decision
+func (p *Pipeline) Approve(stage string, approver string, comment string) error {
+	st, err := p.stage(stage)
+	if err != nil {
+		return err
+	}
+	return st.Approve(approver, comment)
+}
+
+// Reject the approval stage of the pipeline while it is waiting for a decision
+func (p *Pipeline) Reject(stage string, approver string, comment string) error {
+	st, err := p.stage(stage)
+	if err != nil {
+		return err
+	}
+	return st.Reject(approver, comment)
+}
+
+func (p *Pipeline) stage(name string) (*Stage, error) {
+	for _, st := range p.Stages {
+		if st != nil && st.Name == name {
+			return st, nil
+		}
+	}
+	return nil, fmt.Errorf("pipeline %s has no stage %s", p.Name, name)
+}
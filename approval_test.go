@@ -0,0 +1,78 @@
+package pipeline
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApprovalStage(t *testing.T) {
+	for _, decision := range []ApprovalDecision{Approved, Rejected} {
+		testpipe := New("TestApprovalStage"+string(decision), 100)
+		testpipe.AddStage(NewApprovalStage("release", 0, Approved))
+		subscribe(testpipe)
+
+		if err := testpipe.Approve("release", "ops", "too early"); err == nil {
+			t.Fatalf("expected an error approving a stage which isn't waiting for approval")
+		}
+
+		go func() {
+			for {
+				var err error
+				if decision == Approved {
+					err = testpipe.Approve("release", "ops", "ship it")
+				} else {
+					err = testpipe.Reject("release", "ops", "freeze")
+				}
+				if err == nil {
+					return
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+		}()
+		result := testpipe.Run()
+
+		if decision == Rejected && !errors.Is(result.Error, ErrRejected) {
+			t.Fatalf("expected the rejected stage to fail, got %v", result.Error)
+		}
+		if decision == Approved && result.Error != nil {
+			t.Fatalf("expected the approved stage to succeed, got %v", result.Error)
+		}
+
+		approval, ok := result.KeyVal[ApprovalKey("release")].(Approval)
+		if !ok || approval.Decision != decision || approval.Approver != "ops" {
+			t.Fatalf("expected the approval in KeyVal, got %v", result.KeyVal)
+		}
+	}
+}
+
+func TestApprovalTimeout(t *testing.T) {
+	for _, defaultAction := range []ApprovalDecision{Rejected, ""} {
+		testpipe := New("TestApprovalTimeout"+string(defaultAction), 100)
+		testpipe.AddStage(NewApprovalStage("release", time.Millisecond*50, defaultAction))
+		subscribe(testpipe)
+		result := testpipe.Run()
+
+		approval, _ := result.KeyVal[ApprovalKey("release")].(Approval)
+		if !errors.Is(result.Error, ErrRejected) || !approval.TimedOut || approval.Decision != Rejected {
+			t.Fatalf("expected default action %q to reject the approval after the timeout, got %v %v", defaultAction, result.Error, approval)
+		}
+	}
+}
+
+func TestApprovalUnknownDefaultAction(t *testing.T) {
+	testpipe := New("TestApprovalUnknownDefaultAction", 100)
+	testpipe.AddStage(NewApprovalStage("release", time.Millisecond*50, "aproved"))
+
+	verr, ok := testpipe.Validate().(*ValidationError)
+	if !ok || len(verr.Problems) != 1 || !strings.Contains(verr.Problems[0].Message, `"aproved"`) {
+		t.Fatalf("expected the unknown default action to be reported, got %v", verr)
+	}
+
+	subscribe(testpipe)
+	result := testpipe.Run()
+	if result.Error == nil || errors.Is(result.Error, ErrRejected) {
+		t.Fatalf("expected the unknown default action to fail the stage, got %v", result.Error)
+	}
+}
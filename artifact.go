@@ -0,0 +1,339 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoArtifact is returned when fetching an artifact which wasn't published in the run
+var ErrNoArtifact = errors.New("no artifact")
+
+// Artifact is the metadata of a file published by a step
+type Artifact struct {
+	Name string `json:"name"`
+	// Stage and Step which published the artifact
+	Stage     string    `json:"stage"`
+	Step      string    `json:"step"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Published time.Time `json:"published"`
+}
+
+// ArtifactStore stores the artifacts published by the steps of pipeline runs, keyed by run ID and name.
+// Publishing an artifact replaces the artifact of the same name in the run
+type ArtifactStore interface {
+	// Put stores the content of the artifact, setting its Size, SHA256 and Published time
+	Put(runID string, artifact *Artifact, r io.Reader) error
+	// Get returns ErrNoArtifact if the artifact wasn't published in the run
+	Get(runID string, name string) (io.ReadCloser, *Artifact, error)
+	List(runID string) ([]*Artifact, error)
+	// Delete removes the artifacts of the run
+	Delete(runID string) error
+}
+
+// LocalArtifactStore stores artifacts in a directory per run in Dir
+type LocalArtifactStore struct {
+	Dir string
+	// Retention is the time the artifacts of a run are kept, Cleanup removes older runs. Runs are kept if zero
+	Retention time.Duration
+}
+
+// NewLocalArtifactStore returns a store keeping artifacts in dir for retention
+func NewLocalArtifactStore(dir string, retention time.Duration) *LocalArtifactStore {
+	return &LocalArtifactStore{Dir: dir, Retention: retention}
+}
+
+// Put writes the artifact
+func (l *LocalArtifactStore) Put(runID string, artifact *Artifact, r io.Reader) error {
+	files, meta, err := l.dirs(runID, artifact.Name)
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{files, meta} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	hash := sha256.New()
+	var size int64
+	err = writeFileAtomic(filepath.Join(files, artifact.Name), func(w io.Writer) error {
+		var err error
+		size, err = io.Copy(io.MultiWriter(w, hash), r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	artifact.Size = size
+	artifact.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	artifact.Published = time.Now()
+	data, err := json.Marshal(artifact)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(meta, artifact.Name+".json"), data, 0644)
+}
+
+// Get opens the artifact
+func (l *LocalArtifactStore) Get(runID string, name string) (io.ReadCloser, *Artifact, error) {
+	files, meta, err := l.dirs(runID, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	artifact, err := readArtifact(filepath.Join(meta, name+".json"))
+	if os.IsNotExist(err) {
+		return nil, nil, ErrNoArtifact
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(filepath.Join(files, name))
+	if os.IsNotExist(err) {
+		return nil, nil, ErrNoArtifact
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, artifact, nil
+}
+
+// List returns the artifacts of the run sorted by name
+func (l *LocalArtifactStore) List(runID string) ([]*Artifact, error) {
+	if err := validFileName("run id", runID); err != nil {
+		return nil, err
+	}
+
+	meta := filepath.Join(l.Dir, runID, "meta")
+	entries, err := os.ReadDir(meta)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var artifacts []*Artifact
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		artifact, err := readArtifact(filepath.Join(meta, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, artifact)
+	}
+	return artifacts, nil
+}
+
+// Delete removes the artifacts of the run
+func (l *LocalArtifactStore) Delete(runID string) error {
+	if err := validFileName("run id", runID); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(l.Dir, runID))
+}
+
+// Cleanup removes the artifacts of the runs which haven't published an artifact for longer than Retention.
+// Directories of Dir without artifact metadata are kept
+func (l *LocalArtifactStore) Cleanup() error {
+	if l.Retention <= 0 {
+		return nil
+	}
+
+	runs, err := os.ReadDir(l.Dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, run := range runs {
+		if !run.IsDir() {
+			continue
+		}
+		// directories without meta aren't runs, or are runs whose first artifact is being published
+		info, err := os.Stat(filepath.Join(l.Dir, run.Name(), "meta"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if time.Since(info.ModTime()) <= l.Retention {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(l.Dir, run.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *LocalArtifactStore) dirs(runID string, name string) (files string, meta string, err error) {
+	if err := validFileName("run id", runID); err != nil {
+		return "", "", err
+	}
+	if err := validFileName("artifact name", name); err != nil {
+		return "", "", err
+	}
+	return filepath.Join(l.Dir, runID, "files"), filepath.Join(l.Dir, runID, "meta"), nil
+}
+
+func readArtifact(path string) (*Artifact, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	artifact := &Artifact{}
+	if err := json.Unmarshal(data, artifact); err != nil {
+		return nil, fmt.Errorf("artifact metadata %s: %v", path, err)
+	}
+	return artifact, nil
+}
+
+// runArtifacts is the artifact store of a run, a temporary LocalArtifactStore removed at the end of the run
+// if the pipeline has no Artifacts store
+type runArtifacts struct {
+	runID string
+	store ArtifactStore
+	// tempDir is the directory of the temporary store, created when the first artifact is published or kept
+	// by the failed run being resumed
+	tempDir string
+	sync.Mutex
+}
+
+func (a *runArtifacts) get() (ArtifactStore, error) {
+	a.Lock()
+	defer a.Unlock()
+	if a.store != nil {
+		return a.store, nil
+	}
+
+	if a.tempDir == "" {
+		dir, err := os.MkdirTemp("", "pipeline-artifacts-")
+		if err != nil {
+			return nil, err
+		}
+		a.tempDir = dir
+	}
+	a.store = NewLocalArtifactStore(a.tempDir, 0)
+	return a.store, nil
+}
+
+// close removes the temporary store, or cleans up the runs of the pipeline's store past their retention. If keep
+// is set, the temporary store is kept and its directory returned, so that a failed run can be resumed with its
+// artifacts
+func (a *runArtifacts) close(status func(line string), keep bool) string {
+	a.Lock()
+	defer a.Unlock()
+	if a.tempDir != "" {
+		if keep {
+			status(fmt.Sprintf("keeping the artifacts of run %s in %s", a.runID, a.tempDir))
+			return a.tempDir
+		}
+		os.RemoveAll(a.tempDir)
+		return ""
+	}
+
+	if c, ok := a.store.(interface{ Cleanup() error }); ok {
+		if err := c.Cleanup(); err != nil {
+			status(fmt.Sprintf("error cleaning up artifacts: %v", err))
+		}
+	}
+	return ""
+}
+
+func (sc *StepContext) artifacts() (*runArtifacts, *stepContextVal, error) {
+	ctx := sc.getCtx()
+	if ctx == nil || ctx.run == nil || ctx.run.artifacts == nil {
+		return nil, nil, fmt.Errorf("artifacts are only available to steps run by a pipeline")
+	}
+	return ctx.run.artifacts, ctx, nil
+}
+
+// Publish stores the content of r as an artifact of the pipeline run, which steps run after this step can Fetch
+func (sc *StepContext) Publish(name string, r io.Reader) (*Artifact, error) {
+	a, ctx, err := sc.artifacts()
+	if err != nil {
+		return nil, err
+	}
+	store, err := a.get()
+	if err != nil {
+		return nil, err
+	}
+
+	artifact := &Artifact{Name: name, Stage: ctx.stage, Step: ctx.id}
+	if err := store.Put(a.runID, artifact, r); err != nil {
+		return nil, fmt.Errorf("publishing artifact %s: %w", name, err)
+	}
+	sc.Status(fmt.Sprintf("published artifact %s (%d bytes, sha256 %s)", name, artifact.Size, artifact.SHA256))
+	return artifact, nil
+}
+
+// PublishFile stores the file at path as an artifact of the pipeline run
+func (sc *StepContext) PublishFile(name string, path string) (*Artifact, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return sc.Publish(name, f)
+}
+
+// Fetch opens an artifact published in the pipeline run, the reader must be closed
+func (sc *StepContext) Fetch(name string) (io.ReadCloser, *Artifact, error) {
+	a, _, err := sc.artifacts()
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := a.get()
+	if err != nil {
+		return nil, nil, err
+	}
+	return store.Get(a.runID, name)
+}
+
+// FetchFile writes an artifact published in the pipeline run to the file at path
+func (sc *StepContext) FetchFile(name string, path string) (*Artifact, error) {
+	r, artifact, err := sc.Fetch(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return artifact, f.Close()
+}
+
+// StepContextOf returns the StepContext of the StepFunc invoked with ctx, to publish and fetch artifacts
+// from the function of the step. It returns nil if ctx isn't the context of a StepFunc
+func StepContextOf(ctx context.Context) *StepContext {
+	if s, ok := ctx.Value(stepFuncKey{}).(*StepFunc); ok {
+		return &s.StepContext
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func artifactPipeline(name string, store ArtifactStore) (*Pipeline, *string) {
+	fetched := new(string)
+	build := NewStage("build", false, false)
+	build.AddStep(NewStep("build", func(ctx context.Context, request *Request) *Result {
+		if _, err := StepContextOf(ctx).Publish("app.bin", strings.NewReader("binary")); err != nil {
+			return &Result{Error: err}
+		}
+		return nil
+	}))
+
+	deploy := NewStage("deploy", false, false)
+	deploy.AddStep(NewStep("deploy", func(ctx context.Context, request *Request) *Result {
+		if _, _, err := StepContextOf(ctx).Fetch("missing"); !errors.Is(err, ErrNoArtifact) {
+			return &Result{Error: errors.New("expected ErrNoArtifact fetching a missing artifact")}
+		}
+
+		r, _, err := StepContextOf(ctx).Fetch("app.bin")
+		if err != nil {
+			return &Result{Error: err}
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		*fetched = string(data)
+		return &Result{Error: err}
+	}))
+
+	testpipe := New(name, 100)
+	testpipe.Artifacts = store
+	testpipe.AddStage(build, deploy)
+	subscribe(testpipe)
+	return testpipe, fetched
+}
+
+func TestArtifacts(t *testing.T) {
+	store := NewLocalArtifactStore(t.TempDir(), time.Hour)
+	testpipe, fetched := artifactPipeline("TestArtifacts", store)
+	if result := testpipe.Run(); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if *fetched != "binary" {
+		t.Fatalf("expected the published artifact, got %q", *fetched)
+	}
+
+	artifacts, err := store.List(testpipe.RunID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("binary"))
+	if len(artifacts) != 1 || artifacts[0].Size != 6 || artifacts[0].SHA256 != hex.EncodeToString(sum[:]) || artifacts[0].Stage != "build" {
+		t.Fatalf("expected the metadata of app.bin, got %v", artifacts)
+	}
+
+	unrelated := filepath.Join(store.Dir, "unrelated")
+	if err := os.MkdirAll(unrelated, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	store.Retention = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if err := store.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if artifacts, _ := store.List(testpipe.RunID()); len(artifacts) != 0 {
+		t.Fatalf("expected the artifacts past retention to be removed, got %v", artifacts)
+	}
+	if _, err := os.Stat(unrelated); err != nil {
+		t.Fatalf("expected the directory without artifact metadata to be kept, got %v", err)
+	}
+}
+
+func TestArtifactsTemporaryStore(t *testing.T) {
+	testpipe, fetched := artifactPipeline("TestArtifactsTemporaryStore", nil)
+	if result := testpipe.Run(); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if *fetched != "binary" {
+		t.Fatalf("expected the published artifact, got %q", *fetched)
+	}
+}
+
+func TestArtifactsTemporaryStoreResume(t *testing.T) {
+	testpipe, _ := artifactPipeline("TestArtifactsTemporaryStoreResume", nil)
+	testpipe.Checkpoints = NewFileCheckpointStore(t.TempDir(), nil)
+
+	attempts := 0
+	flaky := NewStage("flaky", false, false)
+	flaky.AddStep(NewStep("flaky", func(ctx context.Context, request *Request) *Result {
+		if attempts++; attempts == 1 {
+			return &Result{Error: errors.New("flaky")}
+		}
+		r, _, err := StepContextOf(ctx).Fetch("app.bin")
+		if err != nil {
+			return &Result{Error: err}
+		}
+		return &Result{Error: r.Close()}
+	}))
+	testpipe.AddStage(flaky)
+
+	if result := testpipe.Run(); result.Error == nil {
+		t.Fatal("expected the first run to fail")
+	}
+	checkpoint, err := testpipe.Checkpoints.Load(testpipe.RunID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(checkpoint.ArtifactsDir); err != nil {
+		t.Fatalf("expected the temporary artifacts of the failed run to be kept, got %v", err)
+	}
+
+	if result := testpipe.ResumeRun(testpipe.RunID()); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if _, err := os.Stat(checkpoint.ArtifactsDir); !os.IsNotExist(err) {
+		t.Fatalf("expected the temporary artifacts to be removed after the resumed run, got %v", err)
+	}
+}
@@ -12,6 +12,8 @@ type buffer struct {
 	// multiple readers
 	out      []chan string
 	progress []chan int64
+	// done is closed when the buffer is removed or replaced at the end of the run
+	done chan struct{}
 }
 
 func (b *buffer) drainBuffer(ctx context.Context) {
@@ -32,6 +34,10 @@ loop:
 	}
 }
 
+func newBuffer(size int) *buffer {
+	return &buffer{in: make(chan string, size), out: []chan string{}, progress: []chan int64{}, done: make(chan struct{})}
+}
+
 type buffers struct {
 	bufferMap map[string]*buffer
 	sync.RWMutex
@@ -49,13 +55,31 @@ func (bfs *buffers) get(key string) (*buffer, bool) {
 func (bfs *buffers) set(key string, value *buffer) {
 	bfs.Lock()
 	defer bfs.Unlock()
+	if old, ok := bfs.bufferMap[key]; ok && old != value {
+		close(old.done)
+	}
 	bfs.bufferMap[key] = value
 }
 
+// ensure returns the buffer of the key, setting a new buffer of the size if there is none
+func (bfs *buffers) ensure(key string, size int) *buffer {
+	bfs.Lock()
+	defer bfs.Unlock()
+	val, ok := bfs.bufferMap[key]
+	if !ok {
+		val = newBuffer(size)
+		bfs.bufferMap[key] = val
+	}
+	return val
+}
+
 // remove buffer
 func (bfs *buffers) remove(key string) {
 	bfs.Lock()
 	defer bfs.Unlock()
+	if old, ok := bfs.bufferMap[key]; ok {
+		close(old.done)
+	}
 	delete(bfs.bufferMap, key)
 }
 
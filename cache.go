@@ -0,0 +1,287 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cacheable is implemented by steps whose result only depends on their request. When the pipeline has a
+// CacheStore, the result of a step is stored under its cache key, and the step isn't executed while the
+// result for the same key is cached. An empty key disables the cache for the execution
+type Cacheable interface {
+	CacheKey(request *Request) (string, error)
+}
+
+// optionalCacheable is implemented by steps of this package which are only cached if configured to
+type optionalCacheable interface {
+	canCache() bool
+}
+
+// CacheEntry is a cached step result
+type CacheEntry struct {
+	Data    interface{}            `json:"data"`
+	KeyVal  map[string]interface{} `json:"keyVal"`
+	Created time.Time              `json:"created"`
+	// Expires is the time after which the entry is ignored, the entry doesn't expire if zero
+	Expires time.Time `json:"expires"`
+	// Nil is set if the step returned a nil result, which leaves the request of the next step unchanged
+	Nil bool `json:"nil"`
+}
+
+func (e *CacheEntry) expired() bool {
+	return !e.Expires.IsZero() && time.Now().After(e.Expires)
+}
+
+// copy returns a copy of the entry, copying the maps and slices of Data and KeyVal
+func (e *CacheEntry) copy() *CacheEntry {
+	c := *e
+	c.Data = copyValue(e.Data)
+	if e.KeyVal != nil {
+		c.KeyVal = copyValue(e.KeyVal).(map[string]interface{})
+	}
+	return &c
+}
+
+// CacheStore stores cached step results. The stores of this package don't return expired entries
+type CacheStore interface {
+	// Get returns false if there is no entry for the key
+	Get(key string) (*CacheEntry, bool, error)
+	Set(key string, entry *CacheEntry) error
+	// Delete invalidates the entry of the key
+	Delete(key string) error
+	// Clear invalidates all the entries
+	Clear() error
+}
+
+// MemoryCacheStore keeps cached results in memory. The maps and slices of Data and KeyVal are copied when an
+// entry is stored and read, so that steps changing them don't change the cached results
+type MemoryCacheStore struct {
+	entries map[string]*CacheEntry
+	sync.Mutex
+}
+
+// NewMemoryCacheStore returns an empty in-memory cache
+func NewMemoryCacheStore() *MemoryCacheStore {
+	return &MemoryCacheStore{entries: make(map[string]*CacheEntry)}
+}
+
+// Get returns the entry of the key
+func (m *MemoryCacheStore) Get(key string) (*CacheEntry, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if entry.expired() {
+		delete(m.entries, key)
+		return nil, false, nil
+	}
+	return entry.copy(), true, nil
+}
+
+// Set stores the entry of the key
+func (m *MemoryCacheStore) Set(key string, entry *CacheEntry) error {
+	m.Lock()
+	defer m.Unlock()
+	m.entries[key] = entry.copy()
+	return nil
+}
+
+// Delete removes the entry of the key
+func (m *MemoryCacheStore) Delete(key string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+// Clear removes all the entries
+func (m *MemoryCacheStore) Clear() error {
+	m.Lock()
+	defer m.Unlock()
+	m.entries = make(map[string]*CacheEntry)
+	return nil
+}
+
+// DiskCacheStore saves each cached result to a file in Dir named after the hash of its key. The codec decides
+// the types Data and KeyVal values are restored as, see Codec
+type DiskCacheStore struct {
+	Dir   string
+	Codec Codec
+}
+
+// NewDiskCacheStore returns a cache saving results in dir, encoded with codec or JSONCodec if nil
+func NewDiskCacheStore(dir string, codec Codec) *DiskCacheStore {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	return &DiskCacheStore{Dir: dir, Codec: codec}
+}
+
+// Get reads the entry of the key
+func (d *DiskCacheStore) Get(key string) (*CacheEntry, bool, error) {
+	data, err := os.ReadFile(d.path(key))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	entry := &CacheEntry{}
+	if err := d.Codec.Unmarshal(data, entry); err != nil {
+		return nil, false, fmt.Errorf("cache entry %s: %v", key, err)
+	}
+	if entry.expired() {
+		return nil, false, d.Delete(key)
+	}
+	return entry, true, nil
+}
+
+// Set writes the entry of the key
+func (d *DiskCacheStore) Set(key string, entry *CacheEntry) error {
+	data, err := d.Codec.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(d.Dir, 0755); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(d.path(key), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// Delete removes the entry of the key
+func (d *DiskCacheStore) Delete(key string) error {
+	if err := os.Remove(d.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Clear removes all the entries
+func (d *DiskCacheStore) Clear() error {
+	entries, err := os.ReadDir(d.Dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".cache") {
+			if err := os.Remove(filepath.Join(d.Dir, e.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *DiskCacheStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.Dir, hex.EncodeToString(sum[:])+".cache")
+}
+
+// cacheKey returns the key of the result of a Cacheable step in the cache store of the run, namespaced by the
+// pipeline, stage and name of the step. An empty key is returned if the step isn't cached
+func (rs *runState) cacheKey(st *Stage, id string, step Step, request *Request) (string, error) {
+	if rs.cache == nil {
+		return "", nil
+	}
+
+	if !canCache(step) {
+		return "", nil
+	}
+
+	key, err := stepCacheKey(step.(Cacheable), request)
+	if err != nil || key == "" {
+		return "", err
+	}
+	return st.pipelineKey + "/" + st.Name + "/" + id + ":" + key, nil
+}
+
+// canCache returns true if the step is Cacheable and configured to be cached. A wrapper is cached if the
+// step it wraps is
+func canCache(step Step) bool {
+	if w, ok := step.(wrapper); ok {
+		_, ok := step.(Cacheable)
+		return ok && canCache(w.unwrap())
+	}
+	if _, ok := step.(Cacheable); !ok {
+		return false
+	}
+	if o, ok := step.(optionalCacheable); ok {
+		return o.canCache()
+	}
+	return true
+}
+
+// stepCacheKey returns the cache key of the step, returning a panic in CacheKey as an error
+func stepCacheKey(c Cacheable, request *Request) (key string, err error) {
+	defer recovered(&err)
+	return c.CacheKey(request)
+}
+
+// cached returns the cached result of the key, nil if the step returned nil. A warning is written to the step
+// output if the store fails
+func (rs *runState) cached(step Step, key string) (*Result, bool) {
+	entry, ok, err := rs.cache.Get(key)
+	if err != nil {
+		step.Status(fmt.Sprintf("error reading cache: %v", err))
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+	if entry.Nil {
+		return nil, true
+	}
+	return &Result{Data: entry.Data, KeyVal: entry.KeyVal}, true
+}
+
+// cacheResult stores the result of the key, writing a warning to the step output if the store fails
+func (rs *runState) cacheResult(step Step, key string, result *Result) {
+	entry := &CacheEntry{Created: time.Now(), Nil: result == nil}
+	if result != nil {
+		entry.Data, entry.KeyVal = result.Data, result.KeyVal
+	}
+	if rs.cacheTTL > 0 {
+		entry.Expires = entry.Created.Add(rs.cacheTTL)
+	}
+
+	if err := rs.cache.Set(key, entry); err != nil {
+		step.Status(fmt.Sprintf("error writing cache: %v", err))
+	}
+}
+
+// CachedBy caches the result of the step under the key returned by fn, see Cacheable
+func (s *StepFunc) CachedBy(fn func(request *Request) (string, error)) *StepFunc {
+	s.cacheKey = fn
+	return s
+}
+
+// CacheKey implements Cacheable with the function set by CachedBy
+func (s *StepFunc) CacheKey(request *Request) (string, error) {
+	if s.cacheKey == nil {
+		return "", nil
+	}
+	return s.cacheKey(request)
+}
+
+func (s *StepFunc) canCache() bool {
+	return s.cacheKey != nil
+}
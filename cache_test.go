@@ -0,0 +1,159 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	stores := map[string]CacheStore{
+		"Memory": NewMemoryCacheStore(),
+		"Disk":   NewDiskCacheStore(t.TempDir(), nil),
+	}
+	for name, store := range stores {
+		runs := 0
+		run := func(version string) *Result {
+			stage := NewStage("build", false, false)
+			stage.AddStep(NewStep("compile", func(ctx context.Context, request *Request) *Result {
+				runs++
+				return &Result{KeyVal: map[string]interface{}{"binary": "app-" + version}}
+			}).CachedBy(func(request *Request) (string, error) {
+				return version, nil
+			}))
+
+			testpipe := New("TestCache"+name, 100)
+			testpipe.Cache = store
+			testpipe.AddStage(stage)
+			subscribe(testpipe)
+			return testpipe.Run()
+		}
+
+		for _, version := range []string{"1.0", "1.0", "1.1"} {
+			result := run(version)
+			if result.Error != nil || result.KeyVal["binary"] != "app-"+version {
+				t.Fatalf("%s: expected the binary of %s, got %v %v", name, version, result.KeyVal, result.Error)
+			}
+		}
+		if runs != 2 {
+			t.Fatalf("%s: expected the second run of 1.0 to be cached, the step ran %d times", name, runs)
+		}
+
+		if err := store.Clear(); err != nil {
+			t.Fatal(err)
+		}
+		run("1.0")
+		if runs != 3 {
+			t.Fatalf("%s: expected the cleared cache to run the step, the step ran %d times", name, runs)
+		}
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	store := NewMemoryCacheStore()
+	store.Set("expired", &CacheEntry{Data: 1, Expires: time.Now().Add(-time.Second)})
+	store.Set("valid", &CacheEntry{Data: 2, Expires: time.Now().Add(time.Hour)})
+
+	if _, ok, _ := store.Get("expired"); ok {
+		t.Fatalf("expected the expired entry to be ignored")
+	}
+	if entry, ok, _ := store.Get("valid"); !ok || fmt.Sprint(entry.Data) != "2" {
+		t.Fatalf("expected the valid entry, got %v", entry)
+	}
+}
+
+func TestWrappedStepCache(t *testing.T) {
+	store := NewMemoryCacheStore()
+	var mu sync.Mutex
+	runs := 0
+	run := func() *Result {
+		start := NewStage("start", false, false)
+		start.AddStep(NewStep("list", func(ctx context.Context, request *Request) *Result {
+			return &Result{KeyVal: map[string]interface{}{"services": []string{"auth", "search"}}}
+		}))
+		build := NewForEachStage("build", "services", true, func(index int, item interface{}) Step {
+			return NewStep("compile", func(ctx context.Context, request *Request) *Result {
+				mu.Lock()
+				runs++
+				mu.Unlock()
+				return &Result{KeyVal: map[string]interface{}{"binary": request.KeyVal[ForEachItem]}}
+			}).CachedBy(func(request *Request) (string, error) {
+				return fmt.Sprint(request.KeyVal[ForEachItem]), nil
+			})
+		})
+
+		testpipe := New("TestWrappedStepCache", 100)
+		testpipe.Cache = store
+		testpipe.AddStage(start, build)
+		subscribe(testpipe)
+		return testpipe.Run()
+	}
+
+	for i := 0; i < 2; i++ {
+		if result := run(); result.Error != nil {
+			t.Fatal(result.Error)
+		}
+	}
+	if runs != 2 {
+		t.Fatalf("expected the foreach steps of the second run to be cached, the steps ran %d times", runs)
+	}
+}
+
+func TestCacheKeyPanic(t *testing.T) {
+	stage := NewStage("build", false, false)
+	stage.AddStep(NewStep("compile", func(ctx context.Context, request *Request) *Result {
+		return nil
+	}).CachedBy(func(request *Request) (string, error) {
+		panic("no key")
+	}))
+
+	testpipe := New("TestCacheKeyPanic", 100)
+	testpipe.Cache = NewMemoryCacheStore()
+	testpipe.AddStage(stage)
+	subscribe(testpipe)
+	result := testpipe.Run()
+
+	var panicErr *PanicError
+	var stepErr *StepError
+	if !errors.As(result.Error, &panicErr) || !errors.As(result.Error, &stepErr) || stepErr.Step != "compile" {
+		t.Fatalf("expected the panic of the cache key in a StepError, got %v", result.Error)
+	}
+}
+
+func TestCacheNilResult(t *testing.T) {
+	store := NewMemoryCacheStore()
+	for i := 0; i < 2; i++ {
+		var seen interface{}
+		stage := NewStage("build", false, false)
+		stage.AddStep(NewStep("check", func(ctx context.Context, request *Request) *Result {
+			return nil
+		}).CachedBy(func(request *Request) (string, error) {
+			return "check", nil
+		}), NewStep("next", func(ctx context.Context, request *Request) *Result {
+			seen = request.KeyVal["k"]
+			request.KeyVal["k"] = "mutated"
+			return &Result{KeyVal: request.KeyVal}
+		}))
+
+		start := NewStage("start", false, false)
+		start.AddStep(NewStep("start", func(ctx context.Context, request *Request) *Result {
+			return &Result{KeyVal: map[string]interface{}{"k": "v"}}
+		}).CachedBy(func(request *Request) (string, error) {
+			return "start", nil
+		}))
+
+		testpipe := New("TestCacheNilResult", 100)
+		testpipe.Cache = store
+		testpipe.AddStage(start, stage)
+		subscribe(testpipe)
+		if result := testpipe.Run(); result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		if seen != "v" {
+			t.Fatalf("run %d: expected the cached results to leave the request of the next step unchanged, got %v", i, seen)
+		}
+	}
+}
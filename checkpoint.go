@@ -0,0 +1,199 @@
+package pipeline
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrNoCheckpoint is returned by CheckpointStore.Load when there is no checkpoint for the run
+var ErrNoCheckpoint = errors.New("no checkpoint")
+
+// Checkpoint is the state of a pipeline run, saved when the run starts and after each completed stage
+type Checkpoint struct {
+	RunID    string                 `json:"runId"`
+	Pipeline string                 `json:"pipeline"`
+	Params   map[string]interface{} `json:"params"`
+	// Stages are the results of the completed stages, in order
+	Stages []StageCheckpoint `json:"stages"`
+	// ArtifactsDir is the temporary artifact store kept by a failed run of a pipeline without Artifacts store
+	ArtifactsDir string `json:"artifactsDir,omitempty"`
+}
+
+// StageCheckpoint is the result of a completed stage
+type StageCheckpoint struct {
+	Stage  string                 `json:"stage"`
+	Data   interface{}            `json:"data"`
+	KeyVal map[string]interface{} `json:"keyVal"`
+}
+
+// CheckpointStore persists the checkpoints of pipeline runs keyed by run ID
+type CheckpointStore interface {
+	Save(checkpoint *Checkpoint) error
+	// Load returns ErrNoCheckpoint if there is no checkpoint for the run
+	Load(runID string) (*Checkpoint, error)
+	Delete(runID string) error
+}
+
+// Codec encodes checkpoints. The codec decides the types Data and KeyVal values are restored as:
+// JSONCodec restores structs as map[string]interface{} and numbers as float64
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is the default Codec
+type JSONCodec struct{}
+
+// Marshal encodes v as JSON
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes JSON data into v
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// FileCheckpointStore saves each checkpoint to a file named after the run ID in Dir
+type FileCheckpointStore struct {
+	Dir   string
+	Codec Codec
+}
+
+// NewFileCheckpointStore returns a store saving checkpoints in dir, encoded with codec or JSONCodec if nil
+func NewFileCheckpointStore(dir string, codec Codec) *FileCheckpointStore {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	return &FileCheckpointStore{Dir: dir, Codec: codec}
+}
+
+// Save writes the checkpoint, replacing the previous checkpoint of the run
+func (f *FileCheckpointStore) Save(checkpoint *Checkpoint) error {
+	path, err := f.path(checkpoint.RunID)
+	if err != nil {
+		return err
+	}
+
+	data, err := f.Codec.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(f.Dir, 0755); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// Load reads the checkpoint of the run
+func (f *FileCheckpointStore) Load(runID string) (*Checkpoint, error) {
+	path, err := f.path(runID)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNoCheckpoint
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := &Checkpoint{}
+	if err := f.Codec.Unmarshal(data, checkpoint); err != nil {
+		return nil, fmt.Errorf("checkpoint %s: %v", runID, err)
+	}
+	return checkpoint, nil
+}
+
+// Delete removes the checkpoint of the run
+func (f *FileCheckpointStore) Delete(runID string) error {
+	path, err := f.path(runID)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (f *FileCheckpointStore) path(runID string) (string, error) {
+	if err := validFileName("run id", runID); err != nil {
+		return "", err
+	}
+	return filepath.Join(f.Dir, runID+".checkpoint"), nil
+}
+
+// newRunID returns a run ID unique to the pipeline run
+func newRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
+
+// checkpoint saves the results of the completed stages, writing a warning to the output if it fails
+func (p *Pipeline) checkpoint(checkpoint *Checkpoint) {
+	if p.Checkpoints == nil {
+		return
+	}
+
+	if err := p.Checkpoints.Save(checkpoint); err != nil {
+		p.status(fmt.Sprintf("error saving checkpoint of run %s: %v", checkpoint.RunID, err))
+	}
+}
+
+// ResumeRun resumes a failed or cancelled run from its checkpoint. The stages completed by the run are
+// skipped and the run restarts from the stage which didn't complete, with the params of the run and the
+// Data and KeyVal of the last completed stage. Stages whose steps were compensated when the run failed aren't
+// completed and run again. Request.Scratchpad isn't restored. The artifacts published by the run can be fetched
+// from the pipeline's Artifacts store, or from the temporary store kept by the failed run if there is none
+func (p *Pipeline) ResumeRun(runID string) *Result {
+	if len(p.Stages) == 0 {
+		return &Result{Error: fmt.Errorf("No stages to be executed")}
+	}
+
+	if p.Checkpoints == nil {
+		return &Result{Error: fmt.Errorf("pipeline %s has no checkpoint store", p.Name)}
+	}
+
+	checkpoint, err := p.Checkpoints.Load(runID)
+	if err != nil {
+		return &Result{Error: fmt.Errorf("resuming run %s: %w", runID, err)}
+	}
+
+	if checkpoint.Pipeline != p.Name {
+		return &Result{Error: fmt.Errorf("run %s is a run of pipeline %s", runID, checkpoint.Pipeline)}
+	}
+	if len(checkpoint.Stages) > len(p.Stages) {
+		return &Result{Error: fmt.Errorf("run %s completed %d stages, pipeline %s has %d", runID, len(checkpoint.Stages), p.Name, len(p.Stages))}
+	}
+	for i, sc := range checkpoint.Stages {
+		if p.Stages[i] != nil && p.Stages[i].nameTemplate == "" && p.Stages[i].Name != sc.Stage {
+			return &Result{Error: fmt.Errorf("run %s completed stage %s, stages[%d] of pipeline %s is %s", runID, sc.Stage, i, p.Name, p.Stages[i].Name)}
+		}
+	}
+
+	// restore the declared types of the params, which the codec may not preserve
+	values, err := p.resolveParams(checkpoint.Params)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	checkpoint.Params = values
+
+	return p.execute(checkpoint)
+}
@@ -0,0 +1,150 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestResumeRun(t *testing.T) {
+	runs := make(map[string]int)
+	fail := true
+	stage := func(name string) *Stage {
+		st := NewStage(name, false, false)
+		st.AddStep(NewStep(name, func(ctx context.Context, request *Request) *Result {
+			runs[name]++
+			if name == "deploy" && fail {
+				return &Result{Error: errors.New("deploy failed")}
+			}
+			kv := map[string]interface{}{}
+			for k, v := range request.KeyVal {
+				kv[k] = v
+			}
+			kv[name] = "done"
+			return &Result{KeyVal: kv}
+		}))
+		return st
+	}
+
+	store := NewFileCheckpointStore(t.TempDir(), nil)
+	newPipe := func() *Pipeline {
+		testpipe := New("TestResumeRun", 100)
+		testpipe.Checkpoints = store
+		testpipe.AddStage(stage("build"), stage("test"), stage("deploy"))
+		subscribe(testpipe)
+		return testpipe
+	}
+
+	testpipe := newPipe()
+	result := testpipe.Run()
+	if result.Error == nil {
+		t.Fatalf("expected the deploy stage to fail")
+	}
+
+	runID := testpipe.RunID()
+	checkpoint, err := store.Load(runID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checkpoint.Stages) != 2 {
+		t.Fatalf("expected 2 completed stages in the checkpoint, got %v", checkpoint.Stages)
+	}
+
+	// resume the run with a new pipeline, as a new process would
+	fail = false
+	resumed := newPipe()
+	result = resumed.ResumeRun(runID)
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if runs["build"] != 1 || runs["test"] != 1 || runs["deploy"] != 2 {
+		t.Fatalf("expected only the failed stage to be run again, got %v", runs)
+	}
+	if result.KeyVal["build"] != "done" || result.KeyVal["deploy"] != "done" {
+		t.Fatalf("expected the KeyVal of the completed stages to be restored, got %v", result.KeyVal)
+	}
+
+	if _, err := store.Load(runID); !errors.Is(err, ErrNoCheckpoint) {
+		t.Fatalf("expected the checkpoint of the successful run to be deleted, got %v", err)
+	}
+
+	// the pipeline can be run again after the resumed run
+	subscribe(resumed)
+	if result := resumed.Run(); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+}
+
+func TestResumeRunFirstStage(t *testing.T) {
+	fail := true
+	stage := NewStage("build", false, false)
+	stage.AddStep(NewStep("build", func(ctx context.Context, request *Request) *Result {
+		if fail {
+			return &Result{Error: errors.New("build failed")}
+		}
+		version, _ := request.Param("version")
+		return &Result{KeyVal: map[string]interface{}{"version": version}}
+	}))
+
+	testpipe := New("TestResumeRunFirstStage", 100)
+	testpipe.Checkpoints = NewFileCheckpointStore(t.TempDir(), nil)
+	testpipe.Params = []Param{{Name: "version", Type: ParamString}}
+	testpipe.AddStage(stage)
+	subscribe(testpipe)
+	if result := testpipe.RunWithParams(map[string]interface{}{"version": "1.2"}); result.Error == nil {
+		t.Fatalf("expected the build stage to fail")
+	}
+
+	// resume the failed run on the same pipeline
+	fail = false
+	subscribe(testpipe)
+	result := testpipe.ResumeRun(testpipe.RunID())
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if result.KeyVal["version"] != "1.2" {
+		t.Fatalf("expected the params of the run to be restored, got %v", result.KeyVal)
+	}
+}
+
+func TestResumeRunAfterCompensation(t *testing.T) {
+	var log []string
+	fail := true
+	stage := func(name string) *Stage {
+		st := NewStage(name, false, false)
+		st.AddStep(NewStep(name, func(ctx context.Context, request *Request) *Result {
+			log = append(log, "exec "+name)
+			if name == "deploy" && fail {
+				return &Result{Error: errors.New("deploy failed")}
+			}
+			return nil
+		}).OnCompensate(func(ctx context.Context, request *Request, result *Result) error {
+			log = append(log, "undo "+name)
+			return nil
+		}))
+		return st
+	}
+
+	testpipe := New("TestResumeRunAfterCompensation", 100)
+	testpipe.Checkpoints = NewFileCheckpointStore(t.TempDir(), nil)
+	testpipe.AddStage(NewStage("build", false, false), stage("db"), stage("deploy"))
+	testpipe.Stages[0].AddStep(NewStep("build", func(ctx context.Context, request *Request) *Result {
+		log = append(log, "exec build")
+		return nil
+	}))
+	subscribe(testpipe)
+	if result := testpipe.Run(); result.Error == nil {
+		t.Fatalf("expected the deploy stage to fail")
+	}
+
+	fail = false
+	subscribe(testpipe)
+	if result := testpipe.ResumeRun(testpipe.RunID()); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	expected := "[exec build exec db exec deploy undo db exec db exec deploy]"
+	if fmt.Sprint(log) != expected {
+		t.Fatalf("expected the compensated stage to run again, got %v", log)
+	}
+}
@@ -0,0 +1,145 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+)
+
+// Compensator is implemented by steps which can undo their work. When a run fails or is cancelled, the steps
+// completed by the run are compensated in the reverse order of their completion, each with the request it was
+// executed with and the result it returned. Compensate is invoked on the copy of the step which was executed
+type Compensator interface {
+	Compensate(request *Request, result *Result) error
+}
+
+// optionalCompensator is implemented by steps of this package which are only compensated if configured to
+type optionalCompensator interface {
+	canCompensate() bool
+}
+
+// CompensationError is the error of a failed or cancelled run whose compensation failed
+type CompensationError struct {
+	// Err is the error of the run
+	Err error
+	// Failures are the errors of the failed compensations, as *StepError
+	Failures []error
+}
+
+func (e *CompensationError) Error() string {
+	return fmt.Sprintf("%v, compensation failed: %v", e.Err, e.Failures)
+}
+
+// Unwrap returns the error of the run
+func (e *CompensationError) Unwrap() error {
+	return e.Err
+}
+
+// completedStep is a completed step execution which can be compensated
+type completedStep struct {
+	stage   string
+	id      string
+	step    Compensator
+	request *Request
+	result  *Result
+	// index is the index of the stage of the pipeline which ran the step, or ran the stage of a nested step
+	index int
+}
+
+// runStage records the index of the running stage of the pipeline for the steps it completes
+func (rs *runState) runStage(index int) {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.stage = index
+}
+
+// completed records a completed execution of a step which can be compensated
+func (rs *runState) completed(stage string, id string, step Step, request *Request, result *Result) {
+	if !canCompensate(step) {
+		return
+	}
+
+	rs.Lock()
+	defer rs.Unlock()
+	rs.completedSteps = append(rs.completedSteps, completedStep{stage: stage, id: id, step: step.(Compensator), request: request, result: result, index: rs.stage})
+}
+
+// canCompensate returns true if the step is a Compensator configured to compensate. A wrapper is compensated
+// if the step it wraps is
+func canCompensate(step Step) bool {
+	if w, ok := step.(wrapper); ok {
+		_, ok := step.(Compensator)
+		return ok && canCompensate(w.unwrap())
+	}
+	if _, ok := step.(Compensator); !ok {
+		return false
+	}
+	if o, ok := step.(optionalCompensator); ok {
+		return o.canCompensate()
+	}
+	return true
+}
+
+// compensate the completed steps in reverse order, returning the index of the first stage of the pipeline
+// with compensated steps, -1 if there are none, and the failed compensations
+func (rs *runState) compensate(status func(line string)) (int, []error) {
+	rs.Lock()
+	completed := rs.completedSteps
+	rs.completedSteps = nil
+	rs.Unlock()
+
+	first := -1
+	var failures []error
+	for i := len(completed) - 1; i >= 0; i-- {
+		c := completed[i]
+		if first < 0 || c.index < first {
+			first = c.index
+		}
+		status(fmt.Sprintf("compensating step %s of stage %s", c.id, c.stage))
+		if err := compensateStep(c); err != nil {
+			status(fmt.Sprintf("compensation of step %s of stage %s failed: %v", c.id, c.stage, err))
+			failures = append(failures, &StepError{Stage: c.stage, Step: c.id, Err: err})
+			continue
+		}
+		status(fmt.Sprintf("compensated step %s of stage %s", c.id, c.stage))
+	}
+	return first, failures
+}
+
+// compensateStep compensates the step, returning a panic in Compensate as an error
+func compensateStep(c completedStep) (err error) {
+	defer recovered(&err)
+	return c.step.Compensate(c.request, c.result)
+}
+
+// compensated compensates the completed steps of a failed or cancelled run. The checkpoint of the run is cut
+// back to the stages before the first compensated stage, so that ResumeRun runs the compensated stages again
+func (p *Pipeline) compensated(rs *runState, checkpoint *Checkpoint, result *Result) *Result {
+	first, failures := rs.compensate(p.status)
+	if first >= 0 && first < len(checkpoint.Stages) {
+		checkpoint.Stages = checkpoint.Stages[:first]
+		p.checkpoint(checkpoint)
+	}
+	if len(failures) > 0 {
+		result.Error = &CompensationError{Err: result.Error, Failures: failures}
+	}
+	return result
+}
+
+// OnCompensate sets a hook invoked to undo the work of the step when the run fails or is cancelled after the step
+// completed, with the request the step was executed with and its result
+func (s *StepFunc) OnCompensate(fn func(ctx context.Context, request *Request, result *Result) error) *StepFunc {
+	s.compensate = fn
+	return s
+}
+
+// Compensate invokes the OnCompensate hook
+func (s *StepFunc) Compensate(request *Request, result *Result) error {
+	if s.compensate == nil {
+		return nil
+	}
+	return s.compensate(context.WithValue(context.Background(), stepFuncKey{}, s), request, result)
+}
+
+func (s *StepFunc) canCompensate() bool {
+	return s.compensate != nil
+}
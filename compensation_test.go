@@ -0,0 +1,100 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestCompensation(t *testing.T) {
+	for _, failCompensation := range []bool{false, true} {
+		var compensated []string
+		step := func(name string, fail bool) *StepFunc {
+			return NewStep(name, func(ctx context.Context, request *Request) *Result {
+				if fail {
+					return &Result{Error: errors.New(name + " failed")}
+				}
+				return &Result{Data: name}
+			}).OnCompensate(func(ctx context.Context, request *Request, result *Result) error {
+				compensated = append(compensated, result.Data.(string))
+				if failCompensation && name == "db" {
+					return errors.New("rollback failed")
+				}
+				return nil
+			})
+		}
+
+		testpipe := New(fmt.Sprintf("TestCompensation%v", failCompensation), 100)
+		for _, st := range []struct {
+			name string
+			fail bool
+		}{{"db", false}, {"dns", false}, {"deploy", true}} {
+			stage := NewStage(st.name, false, false)
+			stage.AddStep(step(st.name, st.fail))
+			testpipe.AddStage(stage)
+		}
+		subscribe(testpipe)
+		result := testpipe.Run()
+
+		if fmt.Sprint(compensated) != "[dns db]" {
+			t.Fatalf("expected the completed steps to be compensated in reverse order, got %v", compensated)
+		}
+
+		var cerr *CompensationError
+		if failCompensation != errors.As(result.Error, &cerr) {
+			t.Fatalf("expected a CompensationError only if a compensation failed, got %v", result.Error)
+		}
+		var stepErr *StepError
+		if !errors.As(result.Error, &stepErr) || stepErr.Stage != "deploy" {
+			t.Fatalf("expected the error of the failed stage, got %v", result.Error)
+		}
+	}
+}
+
+func TestWrappedStepCompensation(t *testing.T) {
+	var mu sync.Mutex
+	var compensated []string
+	step := func(name string) *StepFunc {
+		return NewStep(name, func(ctx context.Context, request *Request) *Result {
+			return &Result{KeyVal: request.KeyVal}
+		}).OnCompensate(func(ctx context.Context, request *Request, result *Result) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if i, ok := request.KeyVal[LoopIteration]; ok {
+				compensated = append(compensated, fmt.Sprintf("%s-%v", name, i))
+				return nil
+			}
+			compensated = append(compensated, fmt.Sprintf("%s-%v", name, request.KeyVal[ForEachItem]))
+			return nil
+		})
+	}
+
+	start := NewStage("start", false, false)
+	start.AddStep(NewStep("list", func(ctx context.Context, request *Request) *Result {
+		return &Result{KeyVal: map[string]interface{}{"hosts": []string{"a", "b"}}}
+	}))
+
+	testpipe := New("TestWrappedStepCompensation", 100)
+	testpipe.AddStage(start, NewForEachStage("hosts", "hosts", false, func(index int, item interface{}) Step {
+		return step("host")
+	}))
+	testpipe.AddStage(NewLoopStage("poll", Loop{Until: func(result *Result) bool {
+		return result.KeyVal[LoopIteration] == 2
+	}}, step("poll")))
+	fail := NewStage("deploy", false, false)
+	fail.AddStep(NewStep("deploy", func(ctx context.Context, request *Request) *Result {
+		return &Result{Error: errors.New("deploy failed")}
+	}))
+	testpipe.AddStage(fail)
+	subscribe(testpipe)
+	result := testpipe.Run()
+
+	if result.Error == nil {
+		t.Fatalf("expected the run to fail")
+	}
+	if fmt.Sprint(compensated) != "[poll-2 poll-1 poll-0 host-b host-a]" {
+		t.Fatalf("expected the foreach and loop steps to be compensated in reverse order, got %v", compensated)
+	}
+}
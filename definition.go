@@ -0,0 +1,222 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Definition is the declarative form of a pipeline, loaded from JSON or YAML.
+// Steps are referenced by the type name they are registered with in a Registry.
+// Stage names and step params may reference pipeline parameters as ${name} and
+// keys of Request.KeyVal as ${keyval.key}, which are resolved when the pipeline is run.
+//
+//	name: build
+//	params:
+//	  - name: env
+//	    required: true
+//	stages:
+//	  - name: fetch-${env}
+//	    concurrent: true
+//	    steps:
+//	      - type: download
+//	        params:
+//	          url: http://${env}.example.com/file
+type Definition struct {
+	Name         string            `json:"name" yaml:"name"`
+	OutBufferLen int               `json:"outBufferLen" yaml:"outBufferLen"`
+	Params       []Param           `json:"params" yaml:"params"`
+	Stages       []StageDefinition `json:"stages" yaml:"stages"`
+}
+
+// StageDefinition is the declarative form of a stage
+type StageDefinition struct {
+	Name              string           `json:"name" yaml:"name"`
+	Steps             []StepDefinition `json:"steps" yaml:"steps"`
+	Concurrent        bool             `json:"concurrent" yaml:"concurrent"`
+	DisableStrictMode bool             `json:"disableStrictMode" yaml:"disableStrictMode"`
+	// CancelGracePeriod is a duration such as 30s, the pipeline's CancelGracePeriod if empty
+	CancelGracePeriod string `json:"cancelGracePeriod" yaml:"cancelGracePeriod"`
+}
+
+// StepDefinition references a registered step type and the params passed to its factory
+type StepDefinition struct {
+	// Name identifies the step within its stage, the step type is used if empty
+	Name   string                 `json:"name" yaml:"name"`
+	Type   string                 `json:"type" yaml:"type"`
+	Params map[string]interface{} `json:"params" yaml:"params"`
+}
+
+// ParseJSON parses a JSON pipeline definition. Unknown keys are rejected
+func ParseJSON(data []byte) (*Definition, error) {
+	def := &Definition{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(def); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the pipeline definition")
+	}
+	return def, nil
+}
+
+// ParseYAML parses a YAML pipeline definition. Unknown keys are rejected
+func ParseYAML(data []byte) (*Definition, error) {
+	def := &Definition{}
+	if err := yaml.UnmarshalStrict(data, def); err != nil {
+		return nil, err
+	}
+
+	// yaml decodes nested maps with interface{} keys, params are handed to factories with string keys
+	for i := range def.Params {
+		dflt, err := normalizeYAML(def.Params[i].Default)
+		if err != nil {
+			return nil, fmt.Errorf("params[%d].default: %v", i, err)
+		}
+		def.Params[i].Default = dflt
+	}
+	for i := range def.Stages {
+		for j := range def.Stages[i].Steps {
+			params, err := normalizeYAML(def.Stages[i].Steps[j].Params)
+			if err != nil {
+				return nil, fmt.Errorf("stages[%d].steps[%d].params: %v", i, j, err)
+			}
+			if params != nil {
+				def.Stages[i].Steps[j].Params = params.(map[string]interface{})
+			}
+		}
+	}
+
+	return def, nil
+}
+
+// LoadDefinition reads a pipeline definition from a .json, .yaml or .yml file
+func LoadDefinition(path string) (*Definition, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return ParseJSON(data)
+	case ".yaml", ".yml":
+		return ParseYAML(data)
+	}
+
+	return nil, fmt.Errorf("unknown pipeline definition format %s", path)
+}
+
+// Build creates a pipeline from the definition, resolving the steps via the registry.
+// The default registry is used if registry is nil. The definition is validated first and
+// all the problems found, including step factory errors, are returned in a *ValidationError
+func (d *Definition) Build(registry *Registry) (*Pipeline, error) {
+	if registry == nil {
+		registry = defaultRegistry
+	}
+
+	ps := &problems{}
+	d.validate(ps, registry)
+	if err := ps.err(d.Name); err != nil {
+		return nil, err
+	}
+
+	var stages []*Stage
+	for i, sd := range d.Stages {
+		stage := NewStage(sd.Name, sd.Concurrent, sd.DisableStrictMode)
+		if len(references(sd.Name)) > 0 {
+			stage.nameTemplate = sd.Name
+		}
+		if sd.CancelGracePeriod != "" {
+			// checked by validate
+			stage.CancelGracePeriod, _ = time.ParseDuration(sd.CancelGracePeriod)
+		}
+
+		for j, stepDef := range sd.Steps {
+			stepLoc := fmt.Sprintf("%s.steps[%d](%s)", stageLocation(i, sd.Name), j, stepDef.Type)
+			factory, _ := registry.Lookup(stepDef.Type)
+			// steps referencing parameters or keyval are created when they are executed
+			if len(references(stepDef.Params)) > 0 {
+				stage.AddNamedStep(stepDef.Name, &definedStep{typeName: stepDef.Type, factory: factory, params: stepDef.Params})
+				continue
+			}
+
+			step, err := factory(stepDef.Params)
+			if err != nil {
+				ps.add(stepLoc, "%v", err)
+				continue
+			}
+			if step == nil {
+				ps.add(stepLoc, "step factory returned nil")
+				continue
+			}
+
+			stage.AddNamedStep(stepDef.Name, step)
+		}
+		stages = append(stages, stage)
+	}
+
+	if err := ps.err(d.Name); err != nil {
+		return nil, err
+	}
+
+	outBufferLen := d.OutBufferLen
+	if outBufferLen == 0 {
+		outBufferLen = DefaultBuffer
+	}
+
+	p := New(d.Name, outBufferLen)
+	p.AddParam(d.Params...)
+	p.AddStage(stages...)
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func normalizeYAML(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("non string key %v", k)
+			}
+			n, err := normalizeYAML(item)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = n
+		}
+		return m, nil
+	case map[string]interface{}:
+		for k, item := range val {
+			n, err := normalizeYAML(item)
+			if err != nil {
+				return nil, err
+			}
+			val[k] = n
+		}
+		return val, nil
+	case []interface{}:
+		for i, item := range val {
+			n, err := normalizeYAML(item)
+			if err != nil {
+				return nil, err
+			}
+			val[i] = n
+		}
+		return val, nil
+	}
+
+	return v, nil
+}
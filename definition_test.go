@@ -0,0 +1,203 @@
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type defStep struct {
+	StepContext
+	Message string `json:"message"`
+	Count   int    `json:"count"`
+}
+
+func (d *defStep) Exec(request *Request) *Result {
+	d.Status(fmt.Sprintf("%s x %d", d.Message, d.Count))
+	return &Result{KeyVal: map[string]interface{}{d.Message: d.Count}}
+}
+
+func (d *defStep) Cancel() error {
+	return nil
+}
+
+func newDefRegistry(t *testing.T) *Registry {
+	registry := NewRegistry()
+	err := registry.Register("echo", func(params map[string]interface{}) (Step, error) {
+		step := &defStep{}
+		if err := DecodeParams(params, step); err != nil {
+			return nil, err
+		}
+		return step, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+const testJSONDefinition = `{
+	"name": "jsonDefinition",
+	"stages": [
+		{"name": "first", "concurrent": true, "steps": [
+			{"type": "echo", "params": {"message": "a", "count": 1}},
+			{"type": "echo", "params": {"message": "b", "count": 3}}
+		]},
+		{"name": "second", "steps": [{"type": "echo", "params": {"message": "hello", "count": 2}}]}
+	]
+}`
+
+const testYAMLDefinition = `
+name: yamlDefinition
+stages:
+  - name: first
+    concurrent: true
+    steps:
+      - type: echo
+        params: {message: a, count: 1}
+      - type: echo
+        params: {message: b, count: 3}
+  - name: second
+    steps:
+      - type: echo
+        params:
+          message: hello
+          count: 2
+`
+
+func TestDefinitionBuild(t *testing.T) {
+	registry := newDefRegistry(t)
+
+	parsers := map[string]func() (*Definition, error){
+		"json": func() (*Definition, error) { return ParseJSON([]byte(testJSONDefinition)) },
+		"yaml": func() (*Definition, error) { return ParseYAML([]byte(testYAMLDefinition)) },
+	}
+
+	for format, parse := range parsers {
+		def, err := parse()
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		p, err := def.Build(registry)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		if len(p.Stages) != 2 || len(p.Stages[0].Steps) != 2 || !p.Stages[0].Concurrent {
+			t.Fatalf("%s: unexpected pipeline %+v", format, p.Stages)
+		}
+
+		subscribe(p)
+		result := p.Run()
+		if result.Error != nil {
+			t.Fatalf("%s: %v", format, result.Error)
+		}
+
+		if result.KeyVal["hello"] != 2 {
+			t.Fatalf("%s: unexpected result %v", format, result.KeyVal)
+		}
+	}
+}
+
+func TestDefinitionUnknownType(t *testing.T) {
+	def, err := ParseJSON([]byte(`{"name": "unknownType", "stages": [{"name": "s", "steps": [{"type": "nope"}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := def.Build(newDefRegistry(t)); err == nil {
+		t.Fatal("expected an error for an unregistered step type")
+	}
+}
+
+func TestDefinitionUnknownKey(t *testing.T) {
+	if _, err := ParseJSON([]byte(`{"name": "typo", "stages": [{"name": "s", "concurent": true}]}`)); err == nil {
+		t.Fatal("expected an error for an unknown JSON key")
+	}
+	if _, err := ParseJSON([]byte(`{"name": "trailing"} {}`)); err == nil {
+		t.Fatal("expected an error for data after the JSON definition")
+	}
+	if _, err := ParseYAML([]byte("name: typo\nstages:\n  - name: s\n    concurent: true\n")); err == nil {
+		t.Fatal("expected an error for an unknown YAML key")
+	}
+}
+
+const testParamsDefinition = `
+name: paramsDefinition
+params:
+  - name: env
+    required: true
+  - name: count
+    type: int
+    default: 4
+stages:
+  - name: first-${env}
+    steps:
+      - type: echo
+        params: {message: "${env}", count: "${count}"}
+  - name: second
+    steps:
+      - type: echo
+        params: {message: "after-${keyval.staging}", count: 1}
+`
+
+func TestDefinitionParams(t *testing.T) {
+	def, err := ParseYAML([]byte(testParamsDefinition))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := def.Build(newDefRegistry(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result := p.Run(); result.Error == nil {
+		t.Fatal("expected an error for the missing required parameter")
+	}
+
+	var mu sync.Mutex
+	var lines []string
+	out, _ := p.Out()
+	go func() {
+		for line := range out {
+			mu.Lock()
+			lines = append(lines, line)
+			mu.Unlock()
+		}
+	}()
+	result := p.RunWithParams(map[string]interface{}{"env": "staging"})
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(strings.Join(lines, "\n"), "[first-staging]") {
+		t.Fatalf("expected the resolved stage name in the output, got %v", lines)
+	}
+	if p.Stages[0].Name != "first-${env}" {
+		t.Fatalf("expected the stage to keep its name for the next runs, got %s", p.Stages[0].Name)
+	}
+
+	if result.KeyVal["after-4"] != 1 {
+		t.Fatalf("unexpected result %v", result.KeyVal)
+	}
+}
+
+func TestDefinitionUnresolvedReference(t *testing.T) {
+	def, err := ParseJSON([]byte(`{"name": "unresolved", "stages": [
+		{"name": "s-${missing}", "steps": [{"type": "echo", "params": {"message": "${other}"}}]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = def.Validate(newDefRegistry(t))
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Problems) != 2 {
+		t.Fatalf("expected 2 unresolved references, got %v", err)
+	}
+}
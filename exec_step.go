@@ -0,0 +1,285 @@
+package pipeline
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultExecGracePeriod time given to a cancelled command to exit after SIGTERM before it is killed
+const DefaultExecGracePeriod = time.Second * 10
+
+// DefaultExecTailLines number of output lines of a command kept in the result
+const DefaultExecTailLines = 20
+
+// Result.KeyVal keys set by ExecStep
+const (
+	ExecExitCode = "exitCode"
+	ExecOutput   = "output"
+	ExecDuration = "duration"
+)
+
+// ExecStep is a step which runs a command. The stdout and stderr of the command are streamed line by line
+// to the pipeline output. On Cancel the process group of the command is sent SIGTERM, followed by SIGKILL
+// if it hasn't exited after GracePeriod.
+//
+// The exit code, the last TailLines lines of output and the duration of the command are returned in
+// Result.KeyVal as exitCode, output and duration, along with the Data and KeyVal of the request. A non
+// zero exit code fails the step.
+type ExecStep struct {
+	StepContext
+	Command string
+	Args    []string
+	// Dir is the working directory of the command, the current directory if empty
+	Dir string
+	// Env is added to the environment of the current process
+	Env map[string]string
+	// Shell runs Command as a shell script with Args as its positional parameters
+	Shell       bool
+	GracePeriod time.Duration
+	TailLines   int
+
+	cmd       *exec.Cmd
+	done      chan struct{}
+	cancelled bool
+	sync.Mutex
+}
+
+// NewExecStep returns a step which runs command with args
+func NewExecStep(command string, args ...string) *ExecStep {
+	return &ExecStep{Command: command, Args: args}
+}
+
+// NewShellStep returns a step which runs script with the shell
+func NewShellStep(script string) *ExecStep {
+	return &ExecStep{Command: script, Shell: true}
+}
+
+func (e *ExecStep) cloneStep() Step {
+	return &ExecStep{
+		Command:     e.Command,
+		Args:        e.Args,
+		Dir:         e.Dir,
+		Env:         e.Env,
+		Shell:       e.Shell,
+		GracePeriod: e.GracePeriod,
+		TailLines:   e.TailLines,
+	}
+}
+
+// Exec runs the command and waits for it to exit
+func (e *ExecStep) Exec(request *Request) *Result {
+	cmd := e.command()
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return &Result{Error: err}
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return &Result{Error: err}
+	}
+
+	tailLines := e.TailLines
+	if tailLines <= 0 {
+		tailLines = DefaultExecTailLines
+	}
+	tail := &tailBuffer{max: tailLines}
+
+	e.Lock()
+	if e.cancelled {
+		e.Unlock()
+		return &Result{Error: fmt.Errorf("command %s cancelled", e.Command)}
+	}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		e.Unlock()
+		return &Result{Error: err}
+	}
+	e.cmd = cmd
+	e.done = make(chan struct{})
+	e.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go e.stream(&wg, stdout, "", tail)
+	go e.stream(&wg, stderr, "stderr: ", tail)
+	wg.Wait()
+
+	err = cmd.Wait()
+	duration := time.Since(start)
+	close(e.done)
+
+	e.Lock()
+	cancelled := e.cancelled
+	e.cmd = nil
+	e.Unlock()
+
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+
+	// the data and keys of the request are passed on to the next step
+	keyVal := make(map[string]interface{}, len(request.KeyVal)+3)
+	for k, v := range request.KeyVal {
+		keyVal[k] = v
+	}
+	keyVal[ExecExitCode] = exitCode
+	keyVal[ExecOutput] = tail.String()
+	keyVal[ExecDuration] = duration
+
+	result := &Result{Data: request.Data, KeyVal: keyVal}
+
+	switch {
+	case cancelled:
+		result.Error = fmt.Errorf("command %s cancelled", e.Command)
+	case err != nil:
+		result.Error = fmt.Errorf("command %s failed: %v", e.Command, err)
+	}
+
+	return result
+}
+
+// Cancel signals the process group of the running command
+func (e *ExecStep) Cancel() error {
+	e.Lock()
+	e.cancelled = true
+	cmd := e.cmd
+	done := e.done
+	e.Unlock()
+
+	if cmd == nil {
+		return nil
+	}
+
+	e.Status(fmt.Sprintf("terminating command %s", e.Command))
+	if err := terminate(cmd); err != nil {
+		return err
+	}
+
+	grace := e.GracePeriod
+	if grace <= 0 {
+		grace = DefaultExecGracePeriod
+	}
+
+	go func() {
+		select {
+		case <-done:
+		case <-time.After(grace):
+			e.Status(fmt.Sprintf("killing command %s after %s", e.Command, grace))
+			kill(cmd)
+		}
+	}()
+
+	return nil
+}
+
+func (e *ExecStep) command() *exec.Cmd {
+	var cmd *exec.Cmd
+	if e.Shell {
+		cmd = shellCommand(e.Command, e.Args)
+	} else {
+		cmd = exec.Command(e.Command, e.Args...)
+	}
+
+	cmd.Dir = e.Dir
+	if len(e.Env) > 0 {
+		cmd.Env = os.Environ()
+		for k, v := range e.Env {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+	}
+	setProcessGroup(cmd)
+	return cmd
+}
+
+func (e *ExecStep) stream(wg *sync.WaitGroup, r io.Reader, prefix string, tail *tailBuffer) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		tail.add(line)
+		e.Status(prefix + line)
+	}
+	// drain the rest of the output if a line was too long to scan
+	io.Copy(io.Discard, r)
+}
+
+// tailBuffer keeps the last max lines written to it
+type tailBuffer struct {
+	max   int
+	lines []string
+	sync.Mutex
+}
+
+func (t *tailBuffer) add(line string) {
+	t.Lock()
+	defer t.Unlock()
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
+
+func (t *tailBuffer) String() string {
+	t.Lock()
+	defer t.Unlock()
+	return strings.Join(t.lines, "\n")
+}
+
+// execParams are the params of the exec step type in pipeline definitions
+type execParams struct {
+	Command     string            `json:"command"`
+	Args        []string          `json:"args"`
+	Dir         string            `json:"dir"`
+	Env         map[string]string `json:"env"`
+	Shell       bool              `json:"shell"`
+	GracePeriod string            `json:"gracePeriod"`
+	TailLines   int               `json:"tailLines"`
+}
+
+func newExecStepFromParams(params map[string]interface{}) (Step, error) {
+	ep := execParams{}
+	if err := DecodeParams(params, &ep); err != nil {
+		return nil, err
+	}
+
+	if ep.Command == "" {
+		return nil, fmt.Errorf("command is empty")
+	}
+
+	e := &ExecStep{
+		Command:   ep.Command,
+		Args:      ep.Args,
+		Dir:       ep.Dir,
+		Env:       ep.Env,
+		Shell:     ep.Shell,
+		TailLines: ep.TailLines,
+	}
+
+	if ep.GracePeriod != "" {
+		grace, err := time.ParseDuration(ep.GracePeriod)
+		if err != nil {
+			return nil, fmt.Errorf("gracePeriod: %v", err)
+		}
+		e.GracePeriod = grace
+	}
+
+	return e, nil
+}
+
+// RegisterExecStep makes ExecStep available to pipeline definitions as the exec step type of r, or of the
+// default registry if r is nil. The exec type isn't registered otherwise, since it runs the commands given by
+// the definition
+func RegisterExecStep(r *Registry) error {
+	if r == nil {
+		r = defaultRegistry
+	}
+	return r.Register("exec", newExecStepFromParams)
+}
@@ -0,0 +1,94 @@
+//go:build !windows
+// +build !windows
+
+package pipeline
+
+import (
+	"testing"
+	"time"
+)
+
+func runExecStage(name string, concurrent bool, steps ...Step) *Result {
+	p := New(name, 100)
+	stage := NewStage("exec", concurrent, false)
+	stage.AddStep(steps...)
+	p.AddStage(stage)
+	subscribe(p)
+	return p.Run()
+}
+
+func TestExecStep(t *testing.T) {
+	step := NewShellStep(`echo one; echo two; echo "$FOO $1"`)
+	step.Args = []string{"arg"}
+	step.Env = map[string]string{"FOO": "foo"}
+	step.TailLines = 2
+
+	result := runExecStage("TestExecStep", false, step)
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+
+	if result.KeyVal[ExecExitCode] != 0 {
+		t.Fatalf("unexpected exit code %v", result.KeyVal[ExecExitCode])
+	}
+
+	output := result.KeyVal[ExecOutput].(string)
+	if output != "two\nfoo arg" {
+		t.Fatalf("unexpected output %q", output)
+	}
+}
+
+func TestExecStepExitCode(t *testing.T) {
+	result := runExecStage("TestExecStepExitCode", false, NewShellStep("exit 3"))
+	if result.Error == nil {
+		t.Fatal("expected the step to fail")
+	}
+}
+
+func TestExecStepCancel(t *testing.T) {
+	sleep := NewShellStep("trap '' TERM; sleep 10")
+	sleep.GracePeriod = time.Millisecond * 200
+
+	start := time.Now()
+	result := runExecStage("TestExecStepCancel", true, sleep, NewShellStep("exit 1"))
+	if result.Error == nil {
+		t.Fatal("expected the stage to fail")
+	}
+
+	if time.Since(start) > time.Second*5 {
+		t.Fatalf("cancelled command wasn't killed, took %s", time.Since(start))
+	}
+}
+
+func TestExecStepDefinition(t *testing.T) {
+	def, err := ParseJSON([]byte(`{"name": "TestExecStepDefinition", "stages": [
+		{"name": "keys", "steps": [{"type": "echo", "params": {"message": "hello", "count": 2}}]},
+		{"name": "exec", "steps": [{"type": "exec", "params": {"command": "true"}}]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := newDefRegistry(t)
+	if _, err := def.Build(registry); err == nil {
+		t.Fatal("expected an error for the unregistered exec step type")
+	}
+
+	if err := RegisterExecStep(registry); err != nil {
+		t.Fatal(err)
+	}
+	p, err := def.Build(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscribe(p)
+	result := p.Run()
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+
+	if result.KeyVal["hello"] != 2 || result.KeyVal[ExecExitCode] != 0 {
+		t.Fatalf("expected the keys of the request to be passed on, got %v", result.KeyVal)
+	}
+}
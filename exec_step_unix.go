@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package pipeline
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func shellCommand(script string, args []string) *exec.Cmd {
+	return exec.Command("/bin/sh", append([]string{"-c", script, "sh"}, args...)...)
+}
+
+// setProcessGroup starts the command in a new process group so that it can be signalled with its children
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func terminate(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+func kill(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
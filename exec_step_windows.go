@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package pipeline
+
+import (
+	"os/exec"
+)
+
+func shellCommand(script string, args []string) *exec.Cmd {
+	return exec.Command("cmd", append([]string{"/C", script}, args...)...)
+}
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// terminate kills the process, there is no SIGTERM on windows
+func terminate(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+func kill(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
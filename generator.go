@@ -0,0 +1,50 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+)
+
+// NewGeneratorStage returns a stage whose steps are returned by generate when the stage is run, with the request
+// the stage is run with. The steps are run like the steps added to a stage, concurrently or sequentially and in
+// strict mode unless disabled. A generator returning no steps passes the request on to the next stage
+func NewGeneratorStage(name string, concurrent bool, disableStrictMode bool, generate func(request *Request) ([]Step, error)) *Stage {
+	st := NewStage(name, concurrent, disableStrictMode)
+	st.generate = generate
+	return st
+}
+
+// runGenerated runs the steps generated for this run of the stage on a copy of the stage,
+// so that runs of the stage don't share their steps
+func (st *Stage) runGenerated(rs *runState, parent context.Context, request *Request) *Result {
+	steps, err := st.generateSteps(request)
+	if err != nil {
+		return &Result{Error: fmt.Errorf("stage %s generating steps: %w", st.Name, err)}
+	}
+
+	if len(steps) == 0 {
+		st.status("generated no steps")
+		return &Result{Data: request.Data, KeyVal: request.KeyVal}
+	}
+	for j, step := range steps {
+		if step == nil {
+			return &Result{Error: fmt.Errorf("stage %s generated a nil step at index %d", st.Name, j)}
+		}
+	}
+
+	st.status(fmt.Sprintf("generated %d steps", len(steps)))
+	generated := *st
+	generated.Steps = steps
+	generated.stepNames = nil
+	generated.generate = nil
+	generated.nameTemplate = ""
+	generated.When = nil
+	generated.Locks = nil
+	return generated.run(rs, parent, request)
+}
+
+// generateSteps calls the generator, returning a panic in the generator as an error
+func (st *Stage) generateSteps(request *Request) (steps []Step, err error) {
+	defer recovered(&err)
+	return st.generate(request)
+}
@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestGeneratorStage(t *testing.T) {
+	list := NewStage("list", false, false)
+	list.AddStep(NewStep("changed", func(ctx context.Context, request *Request) *Result {
+		return &Result{KeyVal: map[string]interface{}{"services": "auth,billing,search"}}
+	}))
+
+	build := NewGeneratorStage("build", true, false, func(request *Request) ([]Step, error) {
+		var steps []Step
+		for _, service := range strings.Split(request.KeyVal["services"].(string), ",") {
+			service := service
+			steps = append(steps, NewStep(service, func(ctx context.Context, request *Request) *Result {
+				return &Result{KeyVal: map[string]interface{}{"built": service}}
+			}))
+		}
+		return steps, nil
+	})
+
+	testpipe := New("TestGeneratorStage", 100)
+	testpipe.AddStage(list, build)
+	subscribe(testpipe)
+	result := testpipe.Run()
+
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	for _, service := range []string{"auth", "billing", "search"} {
+		if result.KeyVal[service+".built"] != service {
+			t.Fatalf("expected a step generated for %s, got %v", service, result.KeyVal)
+		}
+	}
+	if len(build.Steps) != 0 {
+		t.Fatalf("expected the generated steps not to be added to the stage")
+	}
+}
+
+func TestGeneratorStageError(t *testing.T) {
+	for i, generate := range []func(request *Request) ([]Step, error){
+		func(request *Request) ([]Step, error) { return nil, errors.New("listing failed") },
+		func(request *Request) ([]Step, error) { panic("listing panicked") },
+	} {
+		testpipe := New(fmt.Sprintf("TestGeneratorStageError%d", i), 100)
+		testpipe.AddStage(NewGeneratorStage("build", false, false, generate))
+		subscribe(testpipe)
+		if result := testpipe.Run(); result.Error == nil {
+			t.Fatalf("expected the generator error to fail the stage")
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Lock is a named lock, or a semaphore if its Capacity is more than 1, held while a stage or step runs.
+// Locks are shared by all the pipelines using the same LockBackend
+type Lock struct {
+	Name     string `json:"name"`
+	Capacity int    `json:"capacity"`
+}
+
+// NewLock returns a lock held by a single stage or step at a time
+func NewLock(name string) Lock {
+	return Lock{Name: name, Capacity: 1}
+}
+
+// NewSemaphore returns a lock held by up to capacity stages or steps at a time
+func NewSemaphore(name string, capacity int) Lock {
+	return Lock{Name: name, Capacity: capacity}
+}
+
+// Locked is implemented by steps which hold locks while they run
+type Locked interface {
+	RequiredLocks() []Lock
+}
+
+// LockBackend acquires named locks
+type LockBackend interface {
+	// Acquire blocks until a slot of the lock is acquired or ctx is done. waiting is invoked once
+	// if the lock isn't available immediately. The returned func releases the slot
+	Acquire(ctx context.Context, lock Lock, waiting func()) (release func() error, err error)
+}
+
+// DefaultLockBackend is the LockBackend of pipelines without a LockBackend, shared by all the runs of the process
+var DefaultLockBackend LockBackend = NewMemoryLockBackend()
+
+// MemoryLockBackend holds locks in memory. The capacity of a lock is set by its first acquisition
+type MemoryLockBackend struct {
+	slots map[string]chan struct{}
+	sync.Mutex
+}
+
+// NewMemoryLockBackend returns an in-process lock backend
+func NewMemoryLockBackend() *MemoryLockBackend {
+	return &MemoryLockBackend{slots: make(map[string]chan struct{})}
+}
+
+// Acquire a slot of the lock
+func (m *MemoryLockBackend) Acquire(ctx context.Context, lock Lock, waiting func()) (func() error, error) {
+	m.Lock()
+	slots, ok := m.slots[lock.Name]
+	if !ok {
+		slots = make(chan struct{}, lockCapacity(lock))
+		m.slots[lock.Name] = slots
+	}
+	m.Unlock()
+
+	if cap(slots) != lockCapacity(lock) {
+		return nil, fmt.Errorf("lock %s has capacity %d, acquired with capacity %d", lock.Name, cap(slots), lockCapacity(lock))
+	}
+
+	release := func() error {
+		<-slots
+		return nil
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if waiting != nil {
+		waiting()
+	}
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func lockCapacity(lock Lock) int {
+	if lock.Capacity < 1 {
+		return 1
+	}
+	return lock.Capacity
+}
+
+// lockPollInterval is the interval between attempts to acquire a lock of a FileLockBackend
+const lockPollInterval = time.Millisecond * 100
+
+type heldLocksKey struct{}
+
+// heldLocks returns the names of the locks held by the stages and steps enclosing the stage or step run with ctx
+func heldLocks(ctx context.Context) map[string]bool {
+	held, _ := ctx.Value(heldLocksKey{}).(map[string]bool)
+	return held
+}
+
+// acquireLocks acquires the locks in the order of their names, so that stages and steps holding several
+// locks don't deadlock. Locks held by an enclosing stage or step, such as the stage of the step or the
+// stage running a sub-pipeline, are re-entrant and aren't acquired again. The returned context records
+// the held locks for the stages and steps run within, and the returned func releases the acquired locks
+// in reverse order
+func acquireLocks(ctx context.Context, backend LockBackend, locks []Lock, status func(line string)) (context.Context, func(), error) {
+	held := heldLocks(ctx)
+	nowHeld := make(map[string]bool, len(held)+len(locks))
+	for name := range held {
+		nowHeld[name] = true
+	}
+
+	var sorted []Lock
+	for _, lock := range locks {
+		if !nowHeld[lock.Name] {
+			nowHeld[lock.Name] = true
+			sorted = append(sorted, lock)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	var releases []func() error
+	release := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			if err := releases[i](); err != nil {
+				status(fmt.Sprintf("error releasing lock %s: %v", sorted[i].Name, err))
+			}
+		}
+	}
+
+	for _, lock := range sorted {
+		lock := lock
+		waited := false
+		r, err := backend.Acquire(ctx, lock, func() {
+			waited = true
+			status("waiting for lock " + lock.Name)
+		})
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		if waited {
+			status("acquired lock " + lock.Name)
+		}
+		releases = append(releases, r)
+	}
+	return context.WithValue(ctx, heldLocksKey{}, nowHeld), release, nil
+}
+
+// requiredLocks returns the locks of the step if it is Locked, or of the step it wraps
+func requiredLocks(step Step) []Lock {
+	if locked, ok := step.(Locked); ok {
+		return locked.RequiredLocks()
+	}
+	if w, ok := step.(wrapper); ok {
+		return requiredLocks(w.unwrap())
+	}
+	return nil
+}
+
+// lockBackend is the backend of the locks of the run
+func (rs *runState) lockBackend() LockBackend {
+	if rs.locks != nil {
+		return rs.locks
+	}
+	return DefaultLockBackend
+}
+
+// WithLocks sets locks held while the step runs, see Locked
+func (s *StepFunc) WithLocks(locks ...Lock) *StepFunc {
+	s.locks = locks
+	return s
+}
+
+// RequiredLocks returns the locks set by WithLocks
+func (s *StepFunc) RequiredLocks() []Lock {
+	return s.locks
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package pipeline
+
+import (
+	"testing"
+)
+
+func TestFileLockBackend(t *testing.T) {
+	backend := NewFileLockBackend(t.TempDir())
+	if max := testLockedStages(t, "TestFileLockBackend", backend, NewLock("env:staging"), 3); max != 1 {
+		t.Fatalf("expected the locked stages not to overlap, got %d at once", max)
+	}
+	if max := testLockedStages(t, "TestFileSemaphore", backend, NewSemaphore("db", 2), 4); max != 2 {
+		t.Fatalf("expected 2 stages holding the semaphore at once, got %d", max)
+	}
+}
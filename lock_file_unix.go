@@ -0,0 +1,77 @@
+//go:build !windows
+// +build !windows
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// FileLockBackend holds locks with flock on files in Dir, so that locks are shared by the processes of a host.
+// A lock of capacity n is held on one of n files named after the lock
+type FileLockBackend struct {
+	Dir string
+}
+
+// NewFileLockBackend returns a lock backend keeping its lock files in dir
+func NewFileLockBackend(dir string) *FileLockBackend {
+	return &FileLockBackend{Dir: dir}
+}
+
+// Acquire a slot of the lock, polling the lock files until one is free
+func (f *FileLockBackend) Acquire(ctx context.Context, lock Lock, waiting func()) (func() error, error) {
+	if err := validFileName("lock name", lock.Name); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(f.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		for slot := 0; slot < lockCapacity(lock); slot++ {
+			file, err := f.tryLock(lock.Name, slot)
+			if err != nil {
+				return nil, err
+			}
+			if file != nil {
+				return func() error {
+					defer file.Close()
+					return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+				}, nil
+			}
+		}
+
+		if attempt == 0 && waiting != nil {
+			waiting()
+		}
+		select {
+		case <-time.After(lockPollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// tryLock returns the locked file of the slot, or nil if the slot is held
+func (f *FileLockBackend) tryLock(name string, slot int) (*os.File, error) {
+	path := filepath.Join(f.Dir, name+"."+strconv.Itoa(slot)+".lock")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("lock %s: %v", name, err)
+	}
+	return file, nil
+}
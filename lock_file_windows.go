@@ -0,0 +1,24 @@
+//go:build windows
+// +build windows
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+)
+
+// FileLockBackend holds locks with flock on files in Dir. It isn't supported on windows
+type FileLockBackend struct {
+	Dir string
+}
+
+// NewFileLockBackend returns a lock backend keeping its lock files in dir
+func NewFileLockBackend(dir string) *FileLockBackend {
+	return &FileLockBackend{Dir: dir}
+}
+
+// Acquire returns an error, file locks aren't supported on windows
+func (f *FileLockBackend) Acquire(ctx context.Context, lock Lock, waiting func()) (func() error, error) {
+	return nil, fmt.Errorf("file locks aren't supported on windows")
+}
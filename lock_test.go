@@ -0,0 +1,159 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// overlapCounter counts the steps running at once
+type overlapCounter struct {
+	running, max int
+	sync.Mutex
+}
+
+func (o *overlapCounter) step(name string) *StepFunc {
+	return NewStep(name, func(ctx context.Context, request *Request) *Result {
+		o.Lock()
+		o.running++
+		if o.running > o.max {
+			o.max = o.running
+		}
+		o.Unlock()
+
+		time.Sleep(time.Millisecond * 20)
+		o.Lock()
+		o.running--
+		o.Unlock()
+		return nil
+	})
+}
+
+// testLockedStages runs pipelines concurrently, each with a stage holding lock, and returns
+// the maximum number of stages run at once
+func testLockedStages(t *testing.T, name string, backend LockBackend, lock Lock, pipelines int) int {
+	counter := &overlapCounter{}
+	var wg sync.WaitGroup
+	for i := 0; i < pipelines; i++ {
+		stage := NewStage("deploy", false, false)
+		stage.Locks = []Lock{lock}
+		stage.AddStep(counter.step("deploy"))
+
+		testpipe := New(fmt.Sprintf("%s%d", name, i), 100)
+		testpipe.LockBackend = backend
+		testpipe.AddStage(stage)
+		subscribe(testpipe)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if result := testpipe.Run(); result.Error != nil {
+				t.Error(result.Error)
+			}
+		}()
+	}
+	wg.Wait()
+	return counter.max
+}
+
+func TestStageLock(t *testing.T) {
+	if max := testLockedStages(t, "TestStageLock", nil, NewLock("env:staging"), 3); max != 1 {
+		t.Fatalf("expected the locked stages not to overlap, got %d at once", max)
+	}
+}
+
+func TestStepSemaphore(t *testing.T) {
+	counter := &overlapCounter{}
+	stage := NewStage("migrate", true, false)
+	for i := 0; i < 4; i++ {
+		stage.AddStep(counter.step(fmt.Sprintf("migrate%d", i)).WithLocks(NewSemaphore("db-migrations", 2)))
+	}
+
+	testpipe := New("TestStepSemaphore", 100)
+	testpipe.LockBackend = NewMemoryLockBackend()
+	testpipe.AddStage(stage)
+	subscribe(testpipe)
+	if result := testpipe.Run(); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if counter.max != 2 {
+		t.Fatalf("expected 2 steps holding the semaphore at once, got %d", counter.max)
+	}
+}
+
+func TestWrappedStepLocks(t *testing.T) {
+	counter := &overlapCounter{}
+	items := NewStage("items", false, false)
+	items.AddStep(NewStep("items", func(ctx context.Context, request *Request) *Result {
+		return &Result{Data: []int{1, 2, 3, 4}}
+	}))
+	foreach := NewForEachStage("foreach", "", true, func(index int, item interface{}) Step {
+		return counter.step("probe").WithLocks(NewLock("probe"))
+	})
+	matrix := NewMatrixStage("matrix", Matrix{Axes: map[string][]interface{}{"n": {1, 2, 3, 4}}}, func(combination map[string]interface{}) Step {
+		return counter.step("probe").WithLocks(NewLock("probe"))
+	})
+
+	testpipe := New("TestWrappedStepLocks", 100)
+	testpipe.LockBackend = NewMemoryLockBackend()
+	testpipe.AddStage(items, foreach, matrix)
+	subscribe(testpipe)
+	if result := testpipe.Run(); result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if counter.max != 1 {
+		t.Fatalf("expected the locks of foreach and matrix steps to be held, got %d steps at once", counter.max)
+	}
+}
+
+func TestReentrantLocks(t *testing.T) {
+	sub := New("sub", 100)
+	subStage := NewStage("migrate", false, false)
+	subStage.Locks = []Lock{NewLock("env")}
+	subStage.AddStep(NewStep("migrate", func(ctx context.Context, request *Request) *Result { return nil }))
+	sub.AddStage(subStage)
+
+	deploy := NewStage("deploy", false, false)
+	deploy.Locks = []Lock{NewLock("env")}
+	deploy.AddStep(NewStep("deploy", func(ctx context.Context, request *Request) *Result {
+		return nil
+	}).WithLocks(NewLock("env")), sub.AsStep())
+
+	testpipe := New("TestReentrantLocks", 100)
+	testpipe.LockBackend = NewMemoryLockBackend()
+	testpipe.AddStage(deploy)
+	subscribe(testpipe)
+
+	done := make(chan *Result, 1)
+	go func() {
+		done <- testpipe.Run()
+	}()
+
+	select {
+	case result := <-done:
+		if result.Error != nil {
+			t.Fatal(result.Error)
+		}
+	case <-time.After(time.Second * 5):
+		testpipe.Cancel()
+		t.Fatalf("expected the locks of the stage to be re-entrant for its steps and sub-pipelines")
+	}
+}
+
+func TestLockCancel(t *testing.T) {
+	backend := NewMemoryLockBackend()
+	release, err := backend.Acquire(context.Background(), NewLock("held"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	waited := false
+	if _, err := backend.Acquire(ctx, NewLock("held"), func() { waited = true }); err == nil || !waited {
+		t.Fatalf("expected to wait for the held lock until ctx is done, got %v", err)
+	}
+}
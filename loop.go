@@ -0,0 +1,230 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Request.KeyVal keys set for the steps of foreach and loop stages
+const (
+	ForEachItem   = "foreach.item"
+	ForEachIndex  = "foreach.index"
+	LoopIteration = "loop.iteration"
+)
+
+// DefaultMaxIterations is the maximum number of iterations of a loop stage if Loop.MaxIterations is zero
+const DefaultMaxIterations = 100
+
+// ErrMaxIterations is the error of a loop stage which didn't end within its maximum number of iterations
+var ErrMaxIterations = errors.New("maximum iterations reached")
+
+// NewForEachStage returns a stage with a step created by factory for each element of a slice, the slice in
+// Request.Data if key is empty or else the slice in Request.KeyVal[key]. The steps are named item-<index>,
+// and the element and its index are set in their Request.KeyVal under ForEachItem and ForEachIndex.
+// Set MaxConcurrency on a concurrent stage to limit the number of steps run at once
+func NewForEachStage(name string, key string, concurrent bool, factory func(index int, item interface{}) Step) *Stage {
+	return NewGeneratorStage(name, concurrent, false, func(request *Request) ([]Step, error) {
+		source, what := request.Data, "Data"
+		if key != "" {
+			source, what = request.KeyVal[key], "KeyVal["+key+"]"
+		}
+		if source == nil {
+			return nil, nil
+		}
+
+		v := reflect.ValueOf(source)
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			return nil, fmt.Errorf("foreach over %s of type %T, expected a slice", what, source)
+		}
+
+		steps := make([]Step, v.Len())
+		for i := range steps {
+			item := v.Index(i).Interface()
+			steps[i] = &keyValStep{
+				name:   "foreach item-" + strconv.Itoa(i),
+				step:   factory(i, item),
+				keyVal: map[string]interface{}{ForEachItem: item, ForEachIndex: i},
+			}
+		}
+		return steps, nil
+	})
+}
+
+// Loop configures a loop stage. At least one of While and Until must be set
+type Loop struct {
+	// While is evaluated with the request of each iteration before it runs, the loop ends when it returns false
+	While func(request *Request) bool
+	// Until is evaluated with the result of each iteration, the loop ends when it returns true
+	Until func(result *Result) bool
+	// MaxIterations fails the stage with ErrMaxIterations if the loop doesn't end within as many iterations,
+	// DefaultMaxIterations if zero
+	MaxIterations int
+	// Interval is the time waited between iterations, such as the interval of a polling loop
+	Interval time.Duration
+}
+
+// NewLoopStage returns a stage which runs step repeatedly until the loop ends. Each iteration runs with the
+// Data and KeyVal of the previous iteration, and the iteration number from 0 in Request.KeyVal under LoopIteration.
+// The result of the last iteration is the result of the stage
+func NewLoopStage(name string, loop Loop, step Step) *Stage {
+	st := NewStage(name, false, false)
+	st.AddNamedStep(stepName(step), &loopStep{loop: loop, step: step})
+	return st
+}
+
+// stepName is the name a step is identified by within its stage, if it is Named
+func stepName(step Step) string {
+	if named, ok := step.(Named); ok && named.StepName() != "" {
+		return named.StepName()
+	}
+	return "loop"
+}
+
+// loopStep runs a step repeatedly, binding a new copy of the step for each iteration
+type loopStep struct {
+	StepContext
+	loop      Loop
+	step      Step
+	current   Step
+	cancelled chan struct{}
+	// iterations are the completed iterations, compensated in reverse order
+	iterations []completedStep
+	sync.Mutex
+}
+
+func (l *loopStep) cloneStep() Step {
+	return &loopStep{loop: l.loop, step: l.step}
+}
+
+func (l *loopStep) Exec(request *Request) *Result {
+	if l.loop.While == nil && l.loop.Until == nil {
+		return &Result{Error: fmt.Errorf("loop has no While or Until condition")}
+	}
+	if l.step == nil {
+		return &Result{Error: fmt.Errorf("loop step is nil")}
+	}
+
+	maxIterations := l.loop.MaxIterations
+	if maxIterations <= 0 {
+		maxIterations = DefaultMaxIterations
+	}
+
+	cancelled := l.cancelChan()
+	r := *request
+	result := &Result{Data: request.Data, KeyVal: request.KeyVal}
+	for i := 0; ; i++ {
+		if l.loop.While != nil && !l.loop.While(&r) {
+			return result
+		}
+		if i >= maxIterations {
+			return &Result{Error: fmt.Errorf("%w: %d", ErrMaxIterations, maxIterations), Data: result.Data, KeyVal: result.KeyVal}
+		}
+
+		if i > 0 && l.loop.Interval > 0 {
+			select {
+			case <-time.After(l.loop.Interval):
+			case <-cancelled:
+			}
+		}
+		select {
+		case <-cancelled:
+			return &Result{Error: fmt.Errorf("loop cancelled after %d iterations", i)}
+		default:
+		}
+
+		l.Status(fmt.Sprintf("iteration %d", i))
+		step := bindStep(l.step, l.getCtx())
+		l.Lock()
+		l.current = step
+		l.Unlock()
+
+		kv := make(map[string]interface{}, len(r.KeyVal)+1)
+		for k, v := range r.KeyVal {
+			kv[k] = v
+		}
+		kv[LoopIteration] = i
+		iteration := r
+		iteration.KeyVal = kv
+
+		res := step.Exec(&iteration)
+		if res == nil {
+			res = &Result{}
+		}
+		if res.Error != nil {
+			return res
+		}
+
+		if c, ok := step.(Compensator); ok && canCompensate(step) {
+			l.Lock()
+			l.iterations = append(l.iterations, completedStep{id: strconv.Itoa(i), step: c, request: &iteration, result: res})
+			l.Unlock()
+		}
+
+		result = res
+		r.Data, r.KeyVal = res.Data, res.KeyVal
+		if l.loop.Until != nil && l.loop.Until(res) {
+			return result
+		}
+	}
+}
+
+// unwrap returns the step of the loop, whose locks are held for all the iterations of the loop
+func (l *loopStep) unwrap() Step {
+	return l.step
+}
+
+// Compensate compensates the completed iterations of the loop in reverse order
+func (l *loopStep) Compensate(request *Request, result *Result) error {
+	l.Lock()
+	iterations := l.iterations
+	l.Unlock()
+
+	var errs []error
+	for i := len(iterations) - 1; i >= 0; i-- {
+		if err := compensateStep(iterations[i]); err != nil {
+			errs = append(errs, fmt.Errorf("iteration %s: %w", iterations[i].id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CacheKey returns the cache key of the step for the request of the first iteration, caching the result of
+// the whole loop
+func (l *loopStep) CacheKey(request *Request) (string, error) {
+	if c, ok := l.step.(Cacheable); ok {
+		return c.CacheKey(request)
+	}
+	return "", nil
+}
+
+// cancelChan returns the channel closed when the loop is cancelled
+func (l *loopStep) cancelChan() chan struct{} {
+	l.Lock()
+	defer l.Unlock()
+	if l.cancelled == nil {
+		l.cancelled = make(chan struct{})
+	}
+	return l.cancelled
+}
+
+// Cancel ends the loop and cancels the running iteration
+func (l *loopStep) Cancel() error {
+	cancelled := l.cancelChan()
+	l.Lock()
+	select {
+	case <-cancelled:
+	default:
+		close(cancelled)
+	}
+	current := l.current
+	l.Unlock()
+
+	if current == nil {
+		return nil
+	}
+	return current.Cancel()
+}
@@ -0,0 +1,83 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestForEachStage(t *testing.T) {
+	for _, concurrent := range []bool{false, true} {
+		var mu sync.Mutex
+		seen := make(map[int]string)
+
+		start := NewStage("start", false, false)
+		start.AddStep(NewStep("list", func(ctx context.Context, request *Request) *Result {
+			return &Result{KeyVal: map[string]interface{}{"services": []string{"auth", "billing", "search"}}}
+		}))
+
+		build := NewForEachStage("build", "services", concurrent, func(index int, item interface{}) Step {
+			return NewStep("build", func(ctx context.Context, request *Request) *Result {
+				mu.Lock()
+				defer mu.Unlock()
+				seen[request.KeyVal[ForEachIndex].(int)] = request.KeyVal[ForEachItem].(string)
+				return &Result{KeyVal: request.KeyVal}
+			})
+		})
+		build.MaxConcurrency = 2
+
+		testpipe := New(fmt.Sprintf("TestForEachStage%v", concurrent), 100)
+		testpipe.AddStage(start, build)
+		subscribe(testpipe)
+		result := testpipe.Run()
+
+		if result.Error != nil {
+			t.Fatal(result.Error)
+		}
+		if fmt.Sprint(seen) != "map[0:auth 1:billing 2:search]" {
+			t.Fatalf("expected a step per element, got %v", seen)
+		}
+	}
+}
+
+func TestForEachStageNotSlice(t *testing.T) {
+	start := NewStage("start", false, false)
+	start.AddStep(NewStep("data", func(ctx context.Context, request *Request) *Result {
+		return &Result{Data: "not a slice"}
+	}))
+
+	testpipe := New("TestForEachStageNotSlice", 100)
+	testpipe.AddStage(start, NewForEachStage("each", "", false, func(index int, item interface{}) Step {
+		return NewStep("each", func(ctx context.Context, request *Request) *Result { return nil })
+	}))
+	subscribe(testpipe)
+	if result := testpipe.Run(); result.Error == nil {
+		t.Fatalf("expected foreach over a string to fail")
+	}
+}
+
+func TestLoopStage(t *testing.T) {
+	poll := NewStep("poll", func(ctx context.Context, request *Request) *Result {
+		return &Result{Data: request.KeyVal[LoopIteration]}
+	})
+
+	testpipe := New("TestLoopStage", 100)
+	testpipe.AddStage(NewLoopStage("wait", Loop{Until: func(result *Result) bool { return result.Data == 3 }}, poll))
+	subscribe(testpipe)
+	result := testpipe.Run()
+
+	if result.Error != nil || result.Data != 3 {
+		t.Fatalf("expected the loop to end after iteration 3, got %v %v", result.Data, result.Error)
+	}
+
+	testpipe = New("TestLoopStageMaxIterations", 100)
+	testpipe.AddStage(NewLoopStage("wait", Loop{Until: func(result *Result) bool { return false }, MaxIterations: 5}, poll))
+	subscribe(testpipe)
+	result = testpipe.Run()
+
+	if !errors.Is(result.Error, ErrMaxIterations) {
+		t.Fatalf("expected ErrMaxIterations, got %v", result.Error)
+	}
+}
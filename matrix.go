@@ -0,0 +1,200 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Matrix is the set of combinations of the values of its axes run by a matrix stage
+type Matrix struct {
+	// Axes are the values of each axis by axis name
+	Axes map[string][]interface{}
+	// Include adds combinations to the matrix, which may have axes of their own
+	Include []map[string]interface{}
+	// Exclude removes the combinations matching all the values of a rule
+	Exclude []map[string]interface{}
+}
+
+// MatrixKey is the key of the value of an axis in the Request.KeyVal of the steps of a matrix stage
+func MatrixKey(axis string) string {
+	return "matrix." + axis
+}
+
+// Combinations returns the combinations of the matrix, ordered by the sorted axis names
+// and the order of the values of each axis, followed by the included combinations
+func (m Matrix) Combinations() []map[string]interface{} {
+	axes := make([]string, 0, len(m.Axes))
+	for axis := range m.Axes {
+		axes = append(axes, axis)
+	}
+	sort.Strings(axes)
+
+	var combinations []map[string]interface{}
+	if len(axes) > 0 {
+		combinations = []map[string]interface{}{{}}
+	}
+	for _, axis := range axes {
+		var next []map[string]interface{}
+		for _, c := range combinations {
+			for _, v := range m.Axes[axis] {
+				combination := make(map[string]interface{}, len(c)+1)
+				for k, cv := range c {
+					combination[k] = cv
+				}
+				combination[axis] = v
+				next = append(next, combination)
+			}
+		}
+		combinations = next
+	}
+
+	var result []map[string]interface{}
+	for _, c := range combinations {
+		if !m.excluded(c) {
+			result = append(result, c)
+		}
+	}
+
+	for _, include := range m.Include {
+		duplicate := false
+		for _, c := range result {
+			if len(c) == len(include) && matches(c, include) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			result = append(result, include)
+		}
+	}
+	return result
+}
+
+func (m Matrix) excluded(combination map[string]interface{}) bool {
+	for _, rule := range m.Exclude {
+		if len(rule) > 0 && matches(combination, rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if the combination has all the values of the rule
+func matches(combination map[string]interface{}, rule map[string]interface{}) bool {
+	for k, v := range rule {
+		cv, ok := combination[k]
+		if !ok || fmt.Sprint(cv) != fmt.Sprint(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// combinationName is the name of the step of a combination, such as go=1.21,os=linux
+func combinationName(combination map[string]interface{}) string {
+	axes := make([]string, 0, len(combination))
+	for axis := range combination {
+		axes = append(axes, axis)
+	}
+	sort.Strings(axes)
+
+	parts := make([]string, len(axes))
+	for i, axis := range axes {
+		parts[i] = fmt.Sprintf("%s=%v", axis, combination[axis])
+	}
+	return strings.Join(parts, ",")
+}
+
+// NewMatrixStage returns a concurrent stage with a step created by factory for each combination of the matrix.
+// The step is named after its combination, and the values of the combination are set in its Request.KeyVal
+// under MatrixKey(axis). Set MaxConcurrency on the stage to limit the number of steps run at once
+func NewMatrixStage(name string, matrix Matrix, factory func(combination map[string]interface{}) Step) *Stage {
+	st := NewStage(name, true, false)
+	for _, combination := range matrix.Combinations() {
+		name := combinationName(combination)
+		keyVal := make(map[string]interface{}, len(combination))
+		for axis, v := range combination {
+			keyVal[MatrixKey(axis)] = v
+		}
+		st.AddNamedStep(name, &keyValStep{name: "matrix " + name, step: factory(combination), keyVal: keyVal})
+	}
+	return st
+}
+
+// keyValStep executes a step created by a factory with values added to Request.KeyVal
+type keyValStep struct {
+	StepContext
+	// name describes the step in errors
+	name   string
+	step   Step
+	keyVal map[string]interface{}
+}
+
+func (k *keyValStep) cloneStep() Step {
+	return &keyValStep{name: k.name, step: k.step, keyVal: k.keyVal}
+}
+
+// setCtx binds the created step along with the keyValStep
+func (k *keyValStep) setCtx(ctx *stepContextVal) {
+	k.StepContext.setCtx(ctx)
+	if k.step != nil {
+		k.step = bindStep(k.step, ctx)
+	}
+}
+
+func (k *keyValStep) Exec(request *Request) *Result {
+	if k.step == nil {
+		return &Result{Error: fmt.Errorf("step factory returned nil for %s", k.name)}
+	}
+
+	return k.step.Exec(k.request(request))
+}
+
+// request returns a copy of the request with the values added to KeyVal
+func (k *keyValStep) request(request *Request) *Request {
+	kv := make(map[string]interface{}, len(request.KeyVal)+len(k.keyVal))
+	for key, v := range request.KeyVal {
+		kv[key] = v
+	}
+	for key, v := range k.keyVal {
+		kv[key] = v
+	}
+
+	r := *request
+	r.KeyVal = kv
+	return &r
+}
+
+func (k *keyValStep) Cancel() error {
+	if k.step == nil {
+		return nil
+	}
+	return k.step.Cancel()
+}
+
+func (k *keyValStep) unwrap() Step {
+	return k.step
+}
+
+// Compensate compensates the created step with the request it was executed with
+func (k *keyValStep) Compensate(request *Request, result *Result) error {
+	if c, ok := k.step.(Compensator); ok {
+		return c.Compensate(k.request(request), result)
+	}
+	return nil
+}
+
+// CacheKey returns the cache key of the created step for the request it is executed with
+func (k *keyValStep) CacheKey(request *Request) (string, error) {
+	if c, ok := k.step.(Cacheable); ok {
+		return c.CacheKey(k.request(request))
+	}
+	return "", nil
+}
+
+// When skips the step if the created step is Conditional
+func (k *keyValStep) When(request *Request) bool {
+	c, ok := k.step.(Conditional)
+	return !ok || c.When(k.request(request))
+}
@@ -0,0 +1,72 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMatrixCombinations(t *testing.T) {
+	m := Matrix{
+		Axes: map[string][]interface{}{
+			"go": {"1.21", "1.22"},
+			"os": {"linux", "windows"},
+		},
+		Exclude: []map[string]interface{}{{"go": "1.21", "os": "windows"}},
+		Include: []map[string]interface{}{{"go": "1.22", "os": "darwin"}, {"go": "1.22", "os": "linux"}},
+	}
+
+	var names []string
+	for _, c := range m.Combinations() {
+		names = append(names, combinationName(c))
+	}
+	expected := "[go=1.21,os=linux go=1.22,os=linux go=1.22,os=windows go=1.22,os=darwin]"
+	if fmt.Sprint(names) != expected {
+		t.Fatalf("expected %s, got %v", expected, names)
+	}
+}
+
+func TestMatrixStage(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	seen := make(map[string]bool)
+
+	stage := NewMatrixStage("test", Matrix{Axes: map[string][]interface{}{
+		"go": {"1.21", "1.22", "1.23"},
+		"db": {"mysql", "postgres"},
+	}}, func(combination map[string]interface{}) Step {
+		return NewStep("test", func(ctx context.Context, request *Request) *Result {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			seen[fmt.Sprintf("%v/%v", request.KeyVal[MatrixKey("go")], request.KeyVal[MatrixKey("db")])] = true
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond * 10)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return nil
+		})
+	})
+	stage.MaxConcurrency = 2
+
+	testpipe := New("TestMatrixStage", 100)
+	testpipe.AddStage(stage)
+	subscribe(testpipe)
+	result := testpipe.Run()
+
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if len(seen) != 6 || !seen["1.22/postgres"] {
+		t.Fatalf("expected a step per combination with its values in KeyVal, got %v", seen)
+	}
+	if maxRunning > 2 {
+		t.Fatalf("expected at most 2 steps run at once, got %d", maxRunning)
+	}
+}
@@ -0,0 +1,152 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// AsStep returns a step which runs the stages of the pipeline as part of the pipeline the step is added to.
+// The nested stages are named after the stage and the name of the step, such as deploy/sub/build, in the output,
+// errors and CancelStage of the parent pipeline. They share the cancellation, pause and Request.Scratchpad of
+// the parent run. The stages start with the Data and KeyVal of the step's request and the parent's values of
+// the params declared by the pipeline, and the result of the last stage is the result of the step
+func (p *Pipeline) AsStep() Step {
+	return &nestedStep{name: p.Name, stages: p.Stages, pipeline: p}
+}
+
+// AsStep returns a step which runs the stage as part of the pipeline the step is added to, like Pipeline.AsStep
+func (st *Stage) AsStep() Step {
+	return &nestedStep{name: st.Name, stages: []*Stage{st}}
+}
+
+// nestedStep runs the stages of a sub-pipeline or a single stage within the run of a parent pipeline
+type nestedStep struct {
+	StepContext
+	name   string
+	stages []*Stage
+	// pipeline declares the params of a sub-pipeline
+	pipeline  *Pipeline
+	cancel    context.CancelCauseFunc
+	cancelled bool
+	sync.Mutex
+}
+
+// StepName returns the name of the pipeline or stage
+func (n *nestedStep) StepName() string {
+	return n.name
+}
+
+func (n *nestedStep) cloneStep() Step {
+	return &nestedStep{name: n.name, stages: n.stages, pipeline: n.pipeline}
+}
+
+func (n *nestedStep) Exec(request *Request) *Result {
+	sc := n.getCtx()
+	if sc == nil {
+		sc = &stepContextVal{id: n.name}
+	}
+
+	rs := sc.run
+	if rs == nil {
+		// executed outside of a pipeline run
+		rs = newRunState(DefaultCancelGracePeriod)
+		defer rs.cancel(nil)
+	}
+
+	ctx, cancel := context.WithCancelCause(rs.ctx)
+	defer cancel(nil)
+	if sc.heldLocks != nil {
+		// the locks held by the parent stage and step are re-entrant for the nested stages
+		ctx = context.WithValue(ctx, heldLocksKey{}, sc.heldLocks)
+	}
+	n.Lock()
+	n.cancel = cancel
+	if n.cancelled {
+		n.cancelled = false
+		cancel(nil)
+	}
+	n.Unlock()
+
+	values, err := n.params(request)
+	if err != nil {
+		return &Result{Error: err}
+	}
+
+	nestedRequest := &Request{Data: request.Data, KeyVal: request.KeyVal, params: values, scratchpad: request.scratchpad}
+	if nestedRequest.scratchpad == nil {
+		nestedRequest.scratchpad = newScratchpad()
+	}
+
+	prefix := sc.id + "/"
+	if sc.stage != "" {
+		prefix = sc.stage + "/" + prefix
+	}
+
+	result := &Result{Data: request.Data, KeyVal: request.KeyVal}
+	for i, stage := range n.stages {
+		if stage == nil {
+			return &Result{Error: fmt.Errorf("nested stage %d of %s is nil", i, n.name)}
+		}
+
+		rs.waitIfPaused(ctx, func(line string) { n.Status(line + " before stage: " + stage.Name) })
+		if ctx.Err() != nil {
+			return &Result{Error: ctxError(ctx)}
+		}
+
+		// run a copy of the stage so that the stage isn't bound to the parent pipeline
+		nested := *stage
+		nested.index = i
+		nested.pipelineKey = sc.pipelineKey
+		if n.pipeline == nil {
+			nested.Name = prefix[:len(prefix)-1]
+			nested.nameTemplate = ""
+		} else {
+			nested.Name = prefix + stage.Name
+			if stage.nameTemplate != "" {
+				nested.nameTemplate = prefix + stage.nameTemplate
+			}
+		}
+
+		result = nested.run(rs, ctx, nestedRequest)
+		if result.Error != nil {
+			return result
+		}
+		nestedRequest.Data = result.Data
+		nestedRequest.KeyVal = result.KeyVal
+	}
+
+	return result
+}
+
+// params returns the values of the params declared by the sub-pipeline, taken from the parent's params
+func (n *nestedStep) params(request *Request) (map[string]interface{}, error) {
+	if n.pipeline == nil {
+		return request.params, nil
+	}
+
+	values := make(map[string]interface{})
+	for _, param := range n.pipeline.Params {
+		if v, ok := request.params[param.Name]; ok {
+			values[param.Name] = v
+		}
+	}
+
+	values, err := n.pipeline.resolveParams(values)
+	if err != nil {
+		return nil, fmt.Errorf("sub-pipeline %s: %w", n.name, err)
+	}
+	return values, nil
+}
+
+// Cancel cancels the running steps of the nested stages
+func (n *nestedStep) Cancel() error {
+	n.Lock()
+	defer n.Unlock()
+	if n.cancel != nil {
+		n.cancel(nil)
+	} else {
+		n.cancelled = true
+	}
+	return nil
+}
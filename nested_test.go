@@ -0,0 +1,93 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPipelineAsStep(t *testing.T) {
+	sub := New("sub", 100)
+	sub.AddParam(Param{Name: "env", Type: ParamString, Default: "staging"})
+	build := NewStage("build", false, false)
+	build.AddStep(NewStep("build", func(ctx context.Context, request *Request) *Result {
+		env, _ := request.Param("env")
+		return &Result{KeyVal: map[string]interface{}{"artifact": request.KeyVal["version"].(string) + "-" + env.(string)}}
+	}))
+	sub.AddStage(build)
+
+	start := NewStage("start", false, false)
+	start.AddStep(NewStep("version", func(ctx context.Context, request *Request) *Result {
+		return &Result{KeyVal: map[string]interface{}{"version": "1.0"}}
+	}))
+	deploy := NewStage("deploy", false, false)
+	deploy.AddStep(sub.AsStep())
+
+	testpipe := New("TestPipelineAsStep", 100)
+	testpipe.AddParam(Param{Name: "env", Type: ParamString})
+	testpipe.AddStage(start, deploy)
+
+	var mu sync.Mutex
+	var lines []string
+	out, _ := testpipe.Out()
+	go func() {
+		for line := range out {
+			mu.Lock()
+			lines = append(lines, line)
+			mu.Unlock()
+		}
+	}()
+	result := testpipe.RunWithParams(map[string]interface{}{"env": "prod"})
+
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if result.KeyVal["artifact"] != "1.0-prod" {
+		t.Fatalf("expected the sub-pipeline result to use the parent's request and params, got %v", result.KeyVal)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(strings.Join(lines, "\n"), "[deploy/sub/build]") {
+		t.Fatalf("expected the nested stage in the parent's output, got %v", lines)
+	}
+}
+
+func TestPipelineAsStepCancel(t *testing.T) {
+	started := make(chan struct{}, 1)
+	sub := New("sub", 100)
+	stage := NewStage("wait", false, false)
+	stage.AddStep(blockingStep("wait", started, nil))
+	sub.AddStage(stage)
+
+	deploy := NewStage("deploy", false, false)
+	deploy.AddStep(sub.AsStep())
+	testpipe := New("TestPipelineAsStepCancel", 100)
+	testpipe.AddStage(deploy)
+	subscribe(testpipe)
+
+	go func() {
+		<-started
+		if err := testpipe.CancelStage("deploy/sub/wait"); err != nil {
+			t.Errorf("cancelling the nested stage: %v", err)
+		}
+	}()
+
+	done := make(chan *Result, 1)
+	go func() {
+		done <- testpipe.Run()
+	}()
+
+	select {
+	case result := <-done:
+		var cancelled *CancelledError
+		if !errors.As(result.Error, &cancelled) || cancelled.Stage != "deploy/sub/wait" {
+			t.Fatalf("expected the nested stage to be cancelled, got %v", result.Error)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("expected the nested stage to be cancelled")
+	}
+}
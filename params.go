@@ -0,0 +1,364 @@
+package pipeline
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ParamType is the type of a pipeline parameter
+type ParamType string
+
+// Pipeline parameter types. Values supplied as strings, e.g. from command line flags, are parsed into the declared type
+const (
+	ParamString ParamType = "string"
+	ParamInt    ParamType = "int"
+	ParamFloat  ParamType = "float"
+	ParamBool   ParamType = "bool"
+)
+
+// Param declares a pipeline parameter supplied at run time with RunWithParams.
+// The value is available to steps from Request.Param and is interpolated as ${name} in stage names and step params of a Definition
+type Param struct {
+	Name        string      `json:"name" yaml:"name"`
+	Type        ParamType   `json:"type" yaml:"type"`
+	Default     interface{} `json:"default" yaml:"default"`
+	Required    bool        `json:"required" yaml:"required"`
+	Description string      `json:"description" yaml:"description"`
+}
+
+// convert coerces v into the declared type of the parameter
+func (pm Param) convert(v interface{}) (interface{}, error) {
+	switch pm.Type {
+	case ParamString, "":
+		switch val := v.(type) {
+		case string:
+			return val, nil
+		case fmt.Stringer:
+			return val.String(), nil
+		}
+		return fmt.Sprint(v), nil
+	case ParamInt:
+		switch val := v.(type) {
+		case int:
+			return val, nil
+		case int64:
+			return int(val), nil
+		case float64:
+			if val == math.Trunc(val) {
+				return int(val), nil
+			}
+		case string:
+			return strconv.Atoi(strings.TrimSpace(val))
+		}
+	case ParamFloat:
+		switch val := v.(type) {
+		case float64:
+			return val, nil
+		case int:
+			return float64(val), nil
+		case int64:
+			return float64(val), nil
+		case string:
+			return strconv.ParseFloat(strings.TrimSpace(val), 64)
+		}
+	case ParamBool:
+		switch val := v.(type) {
+		case bool:
+			return val, nil
+		case string:
+			return strconv.ParseBool(strings.TrimSpace(val))
+		}
+	default:
+		return nil, fmt.Errorf("unknown parameter type %q", pm.Type)
+	}
+
+	return nil, fmt.Errorf("%v is not a valid %s", v, pm.Type)
+}
+
+// AddParam declares pipeline parameters
+func (p *Pipeline) AddParam(param ...Param) {
+	p.Params = append(p.Params, param...)
+}
+
+func (p *Pipeline) hasParam(name string) bool {
+	for _, pm := range p.Params {
+		if pm.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateParams reports invalid parameter declarations and interpolation references to undeclared parameters
+func (p *Pipeline) validateParams(ps *problems) {
+	declared := make(map[string]bool)
+	for i, pm := range p.Params {
+		loc := fmt.Sprintf("params[%d](%s)", i, pm.Name)
+		if pm.Name == "" {
+			ps.add(loc, "parameter name is empty")
+			continue
+		}
+		if strings.HasPrefix(pm.Name, keyValPrefix) {
+			ps.add(loc, "parameter name can't start with %q", keyValPrefix)
+		}
+		if declared[pm.Name] {
+			ps.add(loc, "duplicate parameter name")
+		}
+		declared[pm.Name] = true
+
+		switch pm.Type {
+		case "", ParamString, ParamInt, ParamFloat, ParamBool:
+		default:
+			ps.add(loc, "unknown parameter type %q", pm.Type)
+			continue
+		}
+
+		if pm.Default != nil {
+			if _, err := pm.convert(pm.Default); err != nil {
+				ps.add(loc, "invalid default: %v", err)
+			}
+		}
+	}
+
+	checkRefs := func(loc string, v interface{}) {
+		for _, ref := range references(v) {
+			if !strings.HasPrefix(ref, keyValPrefix) && !declared[ref] {
+				ps.add(loc, "unresolved reference ${%s}", ref)
+			}
+		}
+	}
+
+	for i, stage := range p.Stages {
+		if stage == nil {
+			continue
+		}
+		stageLoc := stageLocation(i, stage.Name)
+		checkRefs(stageLoc, stage.nameTemplate)
+		for j, step := range stage.Steps {
+			if ds, ok := step.(*definedStep); ok {
+				checkRefs(stageLoc+"."+stepLocation(j, step)+".params", ds.params)
+			}
+		}
+	}
+}
+
+// resolveParams applies defaults to the supplied values and converts them into the declared types
+func (p *Pipeline) resolveParams(values map[string]interface{}) (map[string]interface{}, error) {
+	ps := &problems{}
+	resolved := make(map[string]interface{})
+	declared := make(map[string]bool)
+	for _, pm := range p.Params {
+		declared[pm.Name] = true
+		loc := "params." + pm.Name
+		v, ok := values[pm.Name]
+		if !ok || v == nil {
+			if pm.Required {
+				ps.add(loc, "required parameter is missing")
+				continue
+			}
+			if pm.Default == nil {
+				continue
+			}
+			v = pm.Default
+		}
+
+		converted, err := pm.convert(v)
+		if err != nil {
+			ps.add(loc, "%v", err)
+			continue
+		}
+		resolved[pm.Name] = converted
+	}
+
+	var unknown []string
+	for name := range values {
+		if !declared[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		ps.add("params."+name, "unknown parameter")
+	}
+
+	if err := ps.err(p.Name); err != nil {
+		return nil, err
+	}
+	return resolved, nil
+}
+
+// Param returns the value of a pipeline parameter supplied at run time or its default
+func (r *Request) Param(name string) (interface{}, bool) {
+	v, ok := r.params[name]
+	return v, ok
+}
+
+const keyValPrefix = "keyval."
+
+var referencePattern = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// references returns the ${...} references found in the strings of v
+func references(v interface{}) []string {
+	var refs []string
+	switch val := v.(type) {
+	case string:
+		for _, m := range referencePattern.FindAllStringSubmatch(val, -1) {
+			refs = append(refs, strings.TrimSpace(m[1]))
+		}
+	case map[string]interface{}:
+		for _, item := range val {
+			refs = append(refs, references(item)...)
+		}
+	case []interface{}:
+		for _, item := range val {
+			refs = append(refs, references(item)...)
+		}
+	}
+	return refs
+}
+
+// lookup resolves a reference to a pipeline parameter or to a key of Request.KeyVal as keyval.<key>
+func (r *Request) lookup(ref string) (interface{}, error) {
+	if strings.HasPrefix(ref, keyValPrefix) {
+		v, ok := r.KeyVal[strings.TrimPrefix(ref, keyValPrefix)]
+		if !ok {
+			return nil, fmt.Errorf("unresolved reference ${%s}", ref)
+		}
+		return v, nil
+	}
+
+	v, ok := r.params[ref]
+	if !ok {
+		return nil, fmt.Errorf("unresolved reference ${%s}", ref)
+	}
+	return v, nil
+}
+
+// interpolate replaces the ${...} references in the strings of v, returning a copy.
+// A string made of a single reference is replaced by the referenced value keeping its type
+func interpolate(v interface{}, request *Request) (interface{}, error) {
+	switch val := v.(type) {
+	case string:
+		if m := referencePattern.FindStringSubmatch(val); m != nil && m[0] == val {
+			return request.lookup(strings.TrimSpace(m[1]))
+		}
+
+		var err error
+		out := referencePattern.ReplaceAllStringFunc(val, func(ref string) string {
+			resolved, lerr := request.lookup(strings.TrimSpace(ref[2 : len(ref)-1]))
+			if lerr != nil {
+				if err == nil {
+					err = lerr
+				}
+				return ref
+			}
+			return fmt.Sprint(resolved)
+		})
+		return out, err
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			resolved, err := interpolate(item, request)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", k, err)
+			}
+			out[k] = resolved
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			resolved, err := interpolate(item, request)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %v", i, err)
+			}
+			out[i] = resolved
+		}
+		return out, nil
+	}
+
+	return v, nil
+}
+
+// definedStep is a step of a Definition whose params reference pipeline parameters or Request.KeyVal.
+// The step is created by its factory when executed, once the references can be resolved
+type definedStep struct {
+	StepContext
+	typeName string
+	factory  StepFactory
+	params   map[string]interface{}
+	step     Step
+	sync.Mutex
+}
+
+func (d *definedStep) cloneStep() Step {
+	return &definedStep{typeName: d.typeName, factory: d.factory, params: d.params}
+}
+
+// prepare creates the step from the params interpolated against the request. It is called before the locks
+// of the step are acquired, so that the locks, cache key and compensation of the created step are used
+func (d *definedStep) prepare(request *Request) error {
+	params, err := interpolate(d.params, request)
+	if err != nil {
+		return fmt.Errorf("step %s params: %v", d.typeName, err)
+	}
+
+	step, err := d.factory(params.(map[string]interface{}))
+	if err != nil {
+		return fmt.Errorf("step %s: %v", d.typeName, err)
+	}
+	if step == nil {
+		return fmt.Errorf("step factory %s returned nil", d.typeName)
+	}
+
+	step.setCtx(d.getCtx())
+	d.Lock()
+	d.step = step
+	d.Unlock()
+	return nil
+}
+
+// unwrap returns the step created by prepare, nil before the step is prepared
+func (d *definedStep) unwrap() Step {
+	d.Lock()
+	defer d.Unlock()
+	return d.step
+}
+
+func (d *definedStep) Exec(request *Request) *Result {
+	if d.unwrap() == nil {
+		if err := d.prepare(request); err != nil {
+			return &Result{Error: err}
+		}
+	}
+	return d.unwrap().Exec(request)
+}
+
+// Compensate compensates the created step
+func (d *definedStep) Compensate(request *Request, result *Result) error {
+	if c, ok := d.unwrap().(Compensator); ok {
+		return c.Compensate(request, result)
+	}
+	return nil
+}
+
+// CacheKey returns the cache key of the created step
+func (d *definedStep) CacheKey(request *Request) (string, error) {
+	if c, ok := d.unwrap().(Cacheable); ok {
+		return c.CacheKey(request)
+	}
+	return "", nil
+}
+
+func (d *definedStep) Cancel() error {
+	step := d.unwrap()
+	if step == nil {
+		return nil
+	}
+	return step.Cancel()
+}
@@ -2,9 +2,10 @@ package pipeline
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"reflect"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
@@ -17,10 +18,14 @@ const DefaultDrainTimeout = time.Second * 5
 // DefaultBuffer channel buffer size of the output buffer
 const DefaultBuffer = 1000
 
+// DefaultCancelGracePeriod time to wait for a cancelled step to return before it is abandoned
+const DefaultCancelGracePeriod = time.Second * 30
+
 // Pipeline is a sequence of stages
 type Pipeline struct {
 	Name             string   `json:"name"`
 	Stages           []*Stage `json:"stages"`
+	Params           []Param  `json:"params"`
 	DrainTimeout     time.Duration
 	expectedDuration time.Duration
 	duration         time.Duration
@@ -29,6 +34,27 @@ type Pipeline struct {
 	tick             time.Duration
 	cancelDrain      context.CancelFunc
 	cancelProgress   context.CancelFunc
+	// run is the state of the running pipeline
+	run   *runState
+	runMu sync.Mutex
+
+	// CancelGracePeriod is the time a cancelled step is given to return before the stage abandons it
+	CancelGracePeriod time.Duration
+	// PauseTimeout is the time after which a paused pipeline is cancelled, paused pipelines wait for Resume if zero
+	PauseTimeout time.Duration
+	// Checkpoints saves the results of the completed stages of each run, so that a failed run can be resumed
+	// with ResumeRun. The checkpoint of a successful run is deleted
+	Checkpoints CheckpointStore
+	runID       string
+	// Cache stores the results of Cacheable steps, results are cached for CacheTTL or without expiry if zero
+	Cache    CacheStore
+	CacheTTL time.Duration
+	// Artifacts stores the artifacts published by steps with StepContext.Publish. If nil, the artifacts of
+	// each run are stored in a temporary directory removed at the end of the run, or when a failed run is
+	// resumed and succeeds if the pipeline has a checkpoint store
+	Artifacts ArtifactStore
+	// LockBackend holds the locks of stages and steps, DefaultLockBackend if nil
+	LockBackend LockBackend
 }
 
 // New returns a new pipeline
@@ -70,8 +96,11 @@ func newPipeline(name string, outBufferLen int) *Pipeline {
 		p.DrainTimeout = DefaultDrainTimeout
 	}
 
-	buf := buffer{in: make(chan string, outBufferLen), out: []chan string{}, progress: []chan int64{}}
-	buffersMap.set(p.Name, &buf)
+	if p.CancelGracePeriod == 0 {
+		p.CancelGracePeriod = DefaultCancelGracePeriod
+	}
+
+	buffersMap.set(p.Name, newBuffer(outBufferLen))
 
 	return p
 }
@@ -81,19 +110,15 @@ func (p *Pipeline) SetDrainTimeout(timeout time.Duration) {
 	p.DrainTimeout = timeout
 }
 
-// AddStage adds a new stage to the pipeline
+// SetCancelGracePeriod sets CancelGracePeriod
+func (p *Pipeline) SetCancelGracePeriod(grace time.Duration) {
+	p.CancelGracePeriod = grace
+}
+
+// AddStage adds a new stage to the pipeline. The steps are given their step context when the stage is run,
+// so the same step may be added to several stages and pipelines
 func (p *Pipeline) AddStage(stage ...*Stage) {
 	for i := range stage {
-		for j := range stage[i].Steps {
-			ctx := &stepContextVal{
-				name:        p.Name + "." + stage[i].Name + "." + reflect.TypeOf(stage[i].Steps[j]).String(),
-				pipelineKey: p.Name,
-				concurrent:  stage[i].Concurrent,
-				index:       j,
-			}
-
-			stage[i].Steps[j].setCtx(ctx)
-		}
 		stage[i].pipelineKey = p.Name
 	}
 
@@ -102,11 +127,35 @@ func (p *Pipeline) AddStage(stage ...*Stage) {
 
 // Run the pipeline. The stages are executed in sequence while steps may be concurrent or sequential.
 func (p *Pipeline) Run() *Result {
+	return p.RunWithParams(nil)
+}
+
+// RunWithParams runs the pipeline with values for the declared pipeline parameters.
+// Defaults are applied to missing values, and a *ValidationError is returned if a required parameter
+// is missing, a value can't be converted into the declared type or the parameter isn't declared
+func (p *Pipeline) RunWithParams(params map[string]interface{}) *Result {
 
 	if len(p.Stages) == 0 {
 		return &Result{Error: fmt.Errorf("No stages to be executed")}
 	}
 
+	values, err := p.resolveParams(params)
+	if err != nil {
+		return &Result{Error: err}
+	}
+
+	return p.execute(&Checkpoint{RunID: newRunID(), Pipeline: p.Name, Params: values})
+}
+
+// RunID returns the ID of the running or last run of the pipeline
+func (p *Pipeline) RunID() string {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+	return p.runID
+}
+
+// execute the stages which aren't completed in the checkpoint of the run
+func (p *Pipeline) execute(checkpoint *Checkpoint) (result *Result) {
 	var ticker *time.Ticker
 	if p.expectedDuration != 0 && p.tick != 0 {
 		// start progress update ticker
@@ -116,10 +165,8 @@ func (p *Pipeline) Run() *Result {
 		go p.updateProgress(ticker, ctx)
 	}
 
-	buf, ok := buffersMap.get(p.Name)
-	if !ok {
-		return &Result{Error: fmt.Errorf("error creating output %s", p.Name)}
-	}
+	// the output buffer is removed at the end of each run, create it again for the next runs
+	buf := buffersMap.ensure(p.Name, p.outbufferlen)
 
 	ctx, cancelDrain := context.WithCancel(context.Background())
 	p.cancelDrain = cancelDrain
@@ -132,27 +179,90 @@ func (p *Pipeline) Run() *Result {
 	}
 	defer p.status("end")
 
-	p.status("begin")
-	request := &Request{}
-	result := &Result{}
+	rs := newRunState(p.CancelGracePeriod)
+	rs.cache, rs.cacheTTL = p.Cache, p.CacheTTL
+	rs.locks = p.LockBackend
+	rs.artifacts = &runArtifacts{runID: checkpoint.RunID, store: p.Artifacts}
+	if p.Artifacts == nil {
+		rs.artifacts.tempDir = checkpoint.ArtifactsDir
+	}
+	defer func() {
+		// keep the temporary artifacts of a failed run which can be resumed
+		if dir := rs.artifacts.close(p.status, result.Error != nil && p.Checkpoints != nil); dir != "" {
+			checkpoint.ArtifactsDir = dir
+			p.checkpoint(checkpoint)
+		}
+	}()
+	p.runMu.Lock()
+	p.run = rs
+	p.runID = checkpoint.RunID
+	p.runMu.Unlock()
+	defer func() {
+		p.runMu.Lock()
+		p.run = nil
+		p.runMu.Unlock()
+		rs.cancel(nil)
+	}()
+
+	p.status("begin run " + checkpoint.RunID)
+	// save the params of the run, so that a run failing in its first stage can be resumed
+	p.checkpoint(checkpoint)
+	request := &Request{params: checkpoint.Params, scratchpad: newScratchpad()}
+	result = &Result{}
+	if n := len(checkpoint.Stages); n > 0 {
+		last := checkpoint.Stages[n-1]
+		request.Data, request.KeyVal = last.Data, last.KeyVal
+		result = &Result{Data: last.Data, KeyVal: last.KeyVal}
+	}
+
 	for i, stage := range p.Stages {
+		if i < len(checkpoint.Stages) {
+			p.status("stage: " + checkpoint.Stages[i].Stage + " completed in checkpoint, skipped")
+			continue
+		}
+
+		rs.waitIfPaused(rs.ctx, func(line string) { p.status(line + " before stage: " + stage.Name) })
+		if rs.ctx.Err() != nil {
+			p.status("cancelled before stage: " + stage.Name)
+			return p.compensated(rs, checkpoint, &Result{Error: rs.cancelled(stage.Name, context.Cause(rs.ctx))})
+		}
+
 		stage.index = i
-		result = stage.run(request)
+		rs.runStage(i)
+		named, err := stage.named(request)
+		if err != nil {
+			p.status("stage: " + stage.Name + " failed !!! ")
+			return p.compensated(rs, checkpoint, &Result{Error: err})
+		}
+		stage = named
+		result = stage.run(rs, rs.ctx, request)
+		if errors.Is(result.Error, ErrCancelled) {
+			p.status("stage: " + stage.Name + " cancelled")
+			return p.compensated(rs, checkpoint, &Result{Error: rs.cancelled(stage.Name, result.Error), Data: result.Data, KeyVal: result.KeyVal})
+		}
 		if result.Error != nil {
 			p.status("stage: " + stage.Name + " failed !!! ")
-			return result
+			return p.compensated(rs, checkpoint, result)
 		}
 		request.Data = result.Data
 		request.KeyVal = result.KeyVal
+		checkpoint.Stages = append(checkpoint.Stages, StageCheckpoint{Stage: stage.Name, Data: result.Data, KeyVal: result.KeyVal})
+		p.checkpoint(checkpoint)
 	}
 
+	if p.Checkpoints != nil {
+		if err := p.Checkpoints.Delete(checkpoint.RunID); err != nil {
+			p.status(fmt.Sprintf("error deleting checkpoint of run %s: %v", checkpoint.RunID, err))
+		}
+	}
 	return result
 }
 
-// Out collects the status output from the stages and steps
+// Out collects the status output from the stages and steps of the running or next run of the pipeline
 func (p *Pipeline) Out() (<-chan string, error) {
 	// add a new listener
 	out := make(chan string, p.outbufferlen)
+	buffersMap.ensure(p.Name, p.outbufferlen)
 	err := buffersMap.appendOutBuffer(p.Name, out)
 	if err != nil {
 		return nil, err
@@ -168,6 +278,7 @@ func (p *Pipeline) GetDuration() time.Duration {
 // GetProgressPercent of the pipeline
 func (p *Pipeline) GetProgressPercent() (<-chan int64, error) {
 	pg := make(chan int64, 1)
+	buffersMap.ensure(p.Name, p.outbufferlen)
 	err := buffersMap.appendProgressBuffer(p.Name, pg)
 	if err != nil {
 		return nil, err
@@ -179,7 +290,11 @@ func (p *Pipeline) GetProgressPercent() (<-chan int64, error) {
 func (p *Pipeline) updateProgress(ticker *time.Ticker, ctx context.Context) {
 	start := time.Now()
 	for range ticker.C {
+		// paused time is excluded from the duration
 		p.duration = time.Since(start)
+		if rs := p.running(); rs != nil {
+			p.duration -= rs.pausedDuration()
+		}
 		percentDone := int64((p.duration.Seconds() / p.expectedDuration.Seconds()) * 100)
 		// if estimate is incorrect don't overflow progress end
 		if percentDone > 100 {
@@ -1,6 +1,7 @@
 package pipeline
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -224,3 +225,526 @@ loop:
 		}
 	}
 }
+
+func TestStepNames(t *testing.T) {
+	stage := NewStage("names", true, false)
+	stage.AddStep(&TestStep{}, &TestStep{}, &TestStep2{})
+	stage.AddNamedStep("fetch", NewStep("ignored", func(ctx context.Context, request *Request) *Result {
+		return &Result{KeyVal: map[string]interface{}{"bytes": 10}}
+	}))
+	stage.AddStep(NewStep("fail", func(ctx context.Context, request *Request) *Result {
+		time.Sleep(time.Millisecond * 50)
+		return &Result{Error: errors.New("failed")}
+	}))
+
+	ids, err := stage.stepIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"*pipeline.TestStep#0", "*pipeline.TestStep#1", "*pipeline.TestStep2", "fetch", "fail"}
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Fatalf("expected step names %v, got %v", expected, ids)
+		}
+	}
+
+	testpipe := New("TestStepNames", 100)
+	testpipe.AddStage(stage)
+	subscribe(testpipe)
+	result := testpipe.Run()
+
+	stepErr, ok := result.Error.(*StepError)
+	if !ok || stepErr.Stage != "names" || stepErr.Step != "fail" {
+		t.Fatalf("unexpected error %v", result.Error)
+	}
+
+	if result.KeyVal["fetch.bytes"] != 10 {
+		t.Fatalf("expected namespaced key fetch.bytes, got %v", result.KeyVal)
+	}
+
+	stage.AddNamedStep("fetch", &TestStep{})
+	if _, err := stage.stepIDs(); err == nil {
+		t.Fatal("expected an error for duplicate step names")
+	}
+}
+
+type ctxNameStep struct {
+	StepContext
+	names chan string
+}
+
+func (c *ctxNameStep) Exec(request *Request) *Result {
+	time.Sleep(time.Millisecond * 50)
+	c.names <- c.getCtx().name
+	return nil
+}
+
+func (c *ctxNameStep) Cancel() error {
+	return nil
+}
+
+func TestSharedStep(t *testing.T) {
+	shared := &ctxNameStep{names: make(chan string, 4)}
+
+	var pipes []*Pipeline
+	for _, name := range []string{"TestSharedStep1", "TestSharedStep2"} {
+		testpipe := New(name, 100)
+		first := NewStage("first", true, false)
+		first.AddStep(shared)
+		second := NewStage("second", false, false)
+		second.AddStep(shared)
+		testpipe.AddStage(first, second)
+		pipes = append(pipes, testpipe)
+	}
+
+	done := make(chan *Result)
+	for _, testpipe := range pipes {
+		subscribe(testpipe)
+		go func(testpipe *Pipeline) { done <- testpipe.Run() }(testpipe)
+	}
+	for range pipes {
+		if result := <-done; result.Error != nil {
+			t.Fatal(result.Error)
+		}
+	}
+	close(shared.names)
+
+	names := make(map[string]bool)
+	for name := range shared.names {
+		names[name] = true
+	}
+	for _, expected := range []string{
+		"TestSharedStep1.first.*pipeline.ctxNameStep",
+		"TestSharedStep1.second.*pipeline.ctxNameStep",
+		"TestSharedStep2.first.*pipeline.ctxNameStep",
+		"TestSharedStep2.second.*pipeline.ctxNameStep",
+	} {
+		if !names[expected] {
+			t.Fatalf("expected an execution as %s, got %v", expected, names)
+		}
+	}
+
+	if shared.getCtx() != nil {
+		t.Fatal("the shared step shouldn't be bound to an execution")
+	}
+}
+
+func TestConcurrentRequestIsolation(t *testing.T) {
+	stage := NewStage("isolated", true, false)
+	for i := 0; i < 10; i++ {
+		i := i
+		stage.AddStep(NewStep(fmt.Sprintf("step%d", i), func(ctx context.Context, request *Request) *Result {
+			id := fmt.Sprint(i)
+			request.KeyVal["id"] = i
+			request.KeyVal["nested"].(map[string]interface{})["id"] = i
+			request.KeyVal["typed"].(map[string]string)["id"] = id
+			request.KeyVal["list"].([][]string)[0][0] = id
+			time.Sleep(time.Millisecond * 10)
+			if request.KeyVal["id"] != i || request.KeyVal["nested"].(map[string]interface{})["id"] != i {
+				return &Result{Error: errors.New("request modified by another step")}
+			}
+			if request.KeyVal["typed"].(map[string]string)["id"] != id || request.KeyVal["list"].([][]string)[0][0] != id {
+				return &Result{Error: errors.New("typed maps and slices of the request modified by another step")}
+			}
+
+			request.Scratchpad().Update("count", func(v interface{}, ok bool) interface{} {
+				if !ok {
+					return 1
+				}
+				return v.(int) + 1
+			})
+			return nil
+		}))
+	}
+
+	count := NewStage("count", false, false)
+	count.AddStep(NewStep("count", func(ctx context.Context, request *Request) *Result {
+		v, _ := request.Scratchpad().Get("count")
+		return &Result{KeyVal: map[string]interface{}{"count": v}}
+	}))
+
+	testpipe := New("TestConcurrentRequestIsolation", 100)
+	testpipe.AddStage(NewStage("init", false, false), stage, count)
+	testpipe.Stages[0].AddStep(NewStep("init", func(ctx context.Context, request *Request) *Result {
+		return &Result{KeyVal: map[string]interface{}{
+			"nested": map[string]interface{}{},
+			"typed":  map[string]string{},
+			"list":   [][]string{{""}},
+		}}
+	}))
+
+	subscribe(testpipe)
+	result := testpipe.Run()
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if result.KeyVal["count"] != 10 {
+		t.Fatalf("expected 10 scratchpad updates, got %v", result.KeyVal["count"])
+	}
+}
+
+func TestStepPanic(t *testing.T) {
+	for _, concurrent := range []bool{false, true} {
+		stage := NewStage("panic", concurrent, false)
+		stage.AddStep(NewStep("panics", func(ctx context.Context, request *Request) *Result {
+			var kv map[string]int
+			kv["crash"]++
+			return nil
+		}))
+
+		testpipe := New(fmt.Sprintf("TestStepPanic%v", concurrent), 100)
+		testpipe.AddStage(stage)
+		subscribe(testpipe)
+		result := testpipe.Run()
+
+		var panicErr *PanicError
+		if !errors.As(result.Error, &panicErr) || len(panicErr.Stack) == 0 {
+			t.Fatalf("expected a PanicError, got %v", result.Error)
+		}
+	}
+}
+
+// blockingStep blocks until it is cancelled, signalling started once it runs
+func blockingStep(name string, started chan<- struct{}, cancelErr error) *StepFunc {
+	return NewStep(name, func(ctx context.Context, request *Request) *Result {
+		started <- struct{}{}
+		<-ctx.Done()
+		return &Result{Error: ctx.Err()}
+	}).OnCancel(func() error { return cancelErr })
+}
+
+func TestCancel(t *testing.T) {
+	started := make(chan struct{}, 2)
+	stage := NewStage("blocking", true, false)
+	stage.AddStep(blockingStep("a", started, nil), blockingStep("b", started, errors.New("cleanup failed")))
+
+	ran := false
+	next := NewStage("next", false, false)
+	next.AddStep(NewStep("next", func(ctx context.Context, request *Request) *Result {
+		ran = true
+		return nil
+	}))
+
+	testpipe := New("TestCancel", 100)
+	testpipe.AddStage(stage, next)
+	subscribe(testpipe)
+
+	go func() {
+		<-started
+		<-started
+		testpipe.Cancel()
+	}()
+	result := testpipe.Run()
+
+	var cancelled *CancelledError
+	if !errors.As(result.Error, &cancelled) || !errors.Is(result.Error, ErrCancelled) {
+		t.Fatalf("expected a CancelledError, got %v", result.Error)
+	}
+	if cancelled.Stage != "blocking" || cancelled.Step != "" {
+		t.Fatalf("expected the pipeline cancelled in stage blocking, got %v", cancelled)
+	}
+	if len(cancelled.CancelErrors) != 1 {
+		t.Fatalf("expected the cancel error of step b, got %v", cancelled.CancelErrors)
+	}
+	if ran {
+		t.Fatalf("expected the stages after the cancelled stage to be skipped")
+	}
+}
+
+func TestCancelBeforeRun(t *testing.T) {
+	stage := NewStage("step", false, false)
+	stage.AddStep(NewStep("step", func(ctx context.Context, request *Request) *Result {
+		return nil
+	}))
+
+	testpipe := New("TestCancelBeforeRun", 100)
+	testpipe.AddStage(stage)
+	if err := testpipe.Cancel(); err == nil {
+		t.Fatalf("expected an error cancelling a pipeline which isn't running")
+	}
+
+	subscribe(testpipe)
+	if result := testpipe.Run(); result.Error != nil {
+		t.Fatalf("expected the run after the failed cancellation to succeed, got %v", result.Error)
+	}
+}
+
+func TestCancelStep(t *testing.T) {
+	started := make(chan struct{}, 2)
+	stage := NewStage("blocking", true, true)
+	stage.AddStep(blockingStep("a", started, nil))
+	stage.AddStep(NewStep("b", func(ctx context.Context, request *Request) *Result {
+		started <- struct{}{}
+		return nil
+	}))
+
+	testpipe := New("TestCancelStep", 100)
+	testpipe.AddStage(stage)
+	subscribe(testpipe)
+
+	if err := testpipe.CancelStep("blocking", "a"); err == nil {
+		t.Fatalf("expected an error cancelling a step of a pipeline which isn't running")
+	}
+
+	go func() {
+		<-started
+		<-started
+		if err := testpipe.CancelStep("blocking", "a"); err != nil {
+			t.Errorf("cancelling step a: %v", err)
+		}
+	}()
+	result := testpipe.Run()
+
+	var cancelled *CancelledError
+	if !errors.As(result.Error, &cancelled) || cancelled.Stage != "blocking" || cancelled.Step != "a" {
+		t.Fatalf("expected step a of stage blocking cancelled, got %v", result.Error)
+	}
+}
+
+func TestCancelTimeout(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+
+	stage := NewStage("stuck", false, false)
+	stage.CancelGracePeriod = time.Millisecond * 50
+	stage.AddStep(NewStep("ignores-cancel", func(ctx context.Context, request *Request) *Result {
+		started <- struct{}{}
+		<-release
+		return nil
+	}))
+
+	testpipe := New("TestCancelTimeout", 100)
+	testpipe.AddStage(stage)
+	subscribe(testpipe)
+
+	go func() {
+		<-started
+		testpipe.Cancel()
+	}()
+
+	done := make(chan *Result, 1)
+	go func() {
+		done <- testpipe.Run()
+	}()
+
+	select {
+	case result := <-done:
+		var cancelled *CancelledError
+		if !errors.As(result.Error, &cancelled) || len(cancelled.CancelErrors) != 1 ||
+			!errors.Is(cancelled.CancelErrors[0], ErrCancelTimeout) {
+			t.Fatalf("expected a cancel timeout, got %v", result.Error)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("the stage didn't abandon the step after the cancel grace period")
+	}
+}
+
+// pausePipeline returns a pipeline with a sequential stage of two steps: the first step signals started and
+// waits for release, the second step signals second
+func pausePipeline(name string, started chan<- struct{}, release <-chan struct{}, second chan<- struct{}) *Pipeline {
+	stage := NewStage("sequential", false, false)
+	stage.AddStep(NewStep("first", func(ctx context.Context, request *Request) *Result {
+		started <- struct{}{}
+		<-release
+		return nil
+	}), NewStep("second", func(ctx context.Context, request *Request) *Result {
+		second <- struct{}{}
+		return nil
+	}))
+
+	testpipe := New(name, 100)
+	testpipe.AddStage(stage)
+	subscribe(testpipe)
+	return testpipe
+}
+
+func TestPause(t *testing.T) {
+	started, release, second := make(chan struct{}, 1), make(chan struct{}), make(chan struct{}, 1)
+	testpipe := pausePipeline("TestPause", started, release, second)
+	if err := testpipe.Pause(); err == nil {
+		t.Fatalf("expected an error pausing a pipeline which isn't running")
+	}
+
+	done := make(chan *Result, 1)
+	go func() {
+		done <- testpipe.Run()
+	}()
+
+	<-started
+	if err := testpipe.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	select {
+	case <-second:
+		t.Fatalf("expected the paused pipeline to wait before the second step")
+	case <-time.After(time.Millisecond * 100):
+	}
+	if !testpipe.Paused() {
+		t.Fatalf("expected the pipeline to be paused")
+	}
+
+	if err := testpipe.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	<-second
+	if result := <-done; result.Error != nil {
+		t.Fatalf("expected the resumed pipeline to succeed, got %v", result.Error)
+	}
+}
+
+func TestPauseTimeout(t *testing.T) {
+	started, release, second := make(chan struct{}, 1), make(chan struct{}), make(chan struct{}, 1)
+	testpipe := pausePipeline("TestPauseTimeout", started, release, second)
+	testpipe.PauseTimeout = time.Millisecond * 50
+
+	go func() {
+		<-started
+		testpipe.Pause()
+		close(release)
+	}()
+	result := testpipe.Run()
+
+	if !errors.Is(result.Error, ErrCancelled) || !errors.Is(result.Error, ErrPauseTimeout) {
+		t.Fatalf("expected the pipeline to be cancelled after the pause timeout, got %v", result.Error)
+	}
+}
+
+func TestNamespacedKeyVal(t *testing.T) {
+	passThrough := func(key string) Step {
+		return NewStep(key, func(ctx context.Context, request *Request) *Result {
+			kv := map[string]interface{}{}
+			for k, v := range request.KeyVal {
+				kv[k] = v
+			}
+			kv[key] = true
+			return &Result{KeyVal: kv}
+		})
+	}
+
+	first := NewStage("first", true, false)
+	first.AddStep(passThrough("a"), passThrough("b"))
+	second := NewStage("second", true, false)
+	second.AddStep(passThrough("c"), passThrough("d"))
+
+	testpipe := New("TestNamespacedKeyVal", 100)
+	testpipe.AddStage(first, second)
+	subscribe(testpipe)
+	result := testpipe.Run()
+
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	for _, key := range []string{"a", "b", "c", "d", "a.a", "b.b", "c.c", "d.d"} {
+		if result.KeyVal[key] != true {
+			t.Fatalf("expected key %s, got %v", key, result.KeyVal)
+		}
+	}
+	for _, key := range []string{"c.a", "c.a.a", "d.b.b", "a.b"} {
+		if _, ok := result.KeyVal[key]; ok {
+			t.Fatalf("expected the keys passed through to not be namespaced, got %v", result.KeyVal)
+		}
+	}
+}
+
+func TestWhen(t *testing.T) {
+	ran := make(map[string]bool)
+	step := func(name string) *StepFunc {
+		return NewStep(name, func(ctx context.Context, request *Request) *Result {
+			ran[name] = true
+			return &Result{KeyVal: map[string]interface{}{"deploy": name == "build"}}
+		})
+	}
+
+	build := NewStage("build", false, false)
+	build.AddStep(step("build"), step("lint").OnlyWhen(func(request *Request) bool {
+		return false
+	}), step("package").OnlyWhen(func(request *Request) bool {
+		return request.KeyVal["deploy"] == true
+	}))
+
+	release := NewStage("release", false, false)
+	release.When = func(request *Request) bool {
+		branch, _ := request.Param("branch")
+		return branch == "master"
+	}
+	release.AddStep(step("release"))
+
+	testpipe := New("TestWhen", 100)
+	testpipe.AddParam(Param{Name: "branch", Type: ParamString})
+	testpipe.AddStage(build, release)
+	subscribe(testpipe)
+	result := testpipe.RunWithParams(map[string]interface{}{"branch": "feature"})
+
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+	if !ran["build"] || ran["lint"] || !ran["package"] || ran["release"] {
+		t.Fatalf("expected lint and release to be skipped, got %v", ran)
+	}
+}
+
+func TestWhenPanic(t *testing.T) {
+	for _, concurrent := range []bool{false, true} {
+		stage := NewStage("build", concurrent, false)
+		stage.AddStep(NewStep("lint", func(ctx context.Context, request *Request) *Result {
+			return nil
+		}).OnlyWhen(func(request *Request) bool {
+			return request.KeyVal["lint"].(bool)
+		}))
+
+		testpipe := New(fmt.Sprintf("TestWhenPanic%v", concurrent), 100)
+		testpipe.AddStage(stage)
+		subscribe(testpipe)
+		result := testpipe.Run()
+
+		var panicErr *PanicError
+		var stepErr *StepError
+		if !errors.As(result.Error, &panicErr) || !errors.As(result.Error, &stepErr) || stepErr.Step != "lint" {
+			t.Fatalf("expected the panic of the step condition in a StepError, got %v", result.Error)
+		}
+	}
+
+	stage := NewStage("release", false, false)
+	stage.When = func(request *Request) bool {
+		panic("no branch")
+	}
+	stage.AddStep(NewStep("release", func(ctx context.Context, request *Request) *Result {
+		return nil
+	}))
+
+	testpipe := New("TestWhenPanicStage", 100)
+	testpipe.AddStage(stage)
+	subscribe(testpipe)
+	result := testpipe.Run()
+
+	var panicErr *PanicError
+	if !errors.As(result.Error, &panicErr) {
+		t.Fatalf("expected the panic of the stage condition, got %v", result.Error)
+	}
+}
+
+// subscribe reads the output of the pipeline until the end of its run, subscribing before returning so that
+// short runs don't wait for DrainTimeout
+func subscribe(testpipe *Pipeline) {
+	out, err := testpipe.Out()
+	if err != nil {
+		return
+	}
+	buf, ok := buffersMap.get(testpipe.Name)
+	if !ok {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case line := <-out:
+				fmt.Println(line)
+			case <-buf.done:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,79 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// StepFactory creates a step from the params given for it in a pipeline definition
+type StepFactory func(params map[string]interface{}) (Step, error)
+
+// Registry maps the step type names used in pipeline definitions to step factories
+type Registry struct {
+	factories map[string]StepFactory
+	sync.RWMutex
+}
+
+// NewRegistry returns an empty step registry
+func NewRegistry() *Registry {
+	return &Registry{factories: make(map[string]StepFactory)}
+}
+
+// Register adds a step factory for typeName, the name referenced by the type field of a step definition
+func (r *Registry) Register(typeName string, factory StepFactory) error {
+	if typeName == "" {
+		return fmt.Errorf("step type name is empty")
+	}
+
+	if factory == nil {
+		return fmt.Errorf("step factory for %q is nil", typeName)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.factories[typeName]; ok {
+		return fmt.Errorf("step type %q is already registered", typeName)
+	}
+	r.factories[typeName] = factory
+	return nil
+}
+
+// Lookup returns the step factory registered for typeName
+func (r *Registry) Lookup(typeName string) (StepFactory, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	factory, ok := r.factories[typeName]
+	return factory, ok
+}
+
+// Types returns the sorted list of registered step type names
+func (r *Registry) Types() []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	types := make([]string, 0, len(r.factories))
+	for typeName := range r.factories {
+		types = append(types, typeName)
+	}
+	sort.Strings(types)
+	return types
+}
+
+var defaultRegistry = NewRegistry()
+
+// Register adds a step factory for typeName to the default registry
+func Register(typeName string, factory StepFactory) error {
+	return defaultRegistry.Register(typeName, factory)
+}
+
+// DecodeParams decodes step definition params into v, which is typically a pointer to a struct with json tags
+func DecodeParams(params map[string]interface{}, v interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,137 @@
+package pipeline
+
+import (
+	"reflect"
+	"sync"
+)
+
+// Scratchpad is a race safe store shared by all the steps of a pipeline run, for steps which
+// deliberately coordinate with each other, e.g. concurrent steps of a stage. Request.KeyVal is
+// copied for each concurrent step, so changes to it are not seen by the other steps. The maps and
+// slices it contains are copied, pointers and the maps and slices in structs are shared
+type Scratchpad struct {
+	values map[string]interface{}
+	sync.RWMutex
+}
+
+func newScratchpad() *Scratchpad {
+	return &Scratchpad{values: make(map[string]interface{})}
+}
+
+// Get returns the value stored for key
+func (s *Scratchpad) Get(key string) (interface{}, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+// Set stores the value for key
+func (s *Scratchpad) Set(key string, value interface{}) {
+	s.Lock()
+	defer s.Unlock()
+	s.values[key] = value
+}
+
+// Delete removes the value stored for key
+func (s *Scratchpad) Delete(key string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.values, key)
+}
+
+// Update atomically replaces the value stored for key with the value returned by fn.
+// fn receives the current value and whether it was set, and must not use the scratchpad
+func (s *Scratchpad) Update(key string, fn func(value interface{}, ok bool) interface{}) interface{} {
+	s.Lock()
+	defer s.Unlock()
+	v, ok := s.values[key]
+	v = fn(v, ok)
+	s.values[key] = v
+	return v
+}
+
+// Scratchpad returns the store shared by the steps of the pipeline run
+func (r *Request) Scratchpad() *Scratchpad {
+	if r.scratchpad == nil {
+		r.scratchpad = newScratchpad()
+	}
+	return r.scratchpad
+}
+
+// isolate returns a copy of the request for a concurrent step. Data and KeyVal are copied, including the
+// nested maps and slices of any type. Other values, such as pointers and structs, are shared
+func (r *Request) isolate() *Request {
+	if r.scratchpad == nil {
+		r.scratchpad = newScratchpad()
+	}
+
+	c := &Request{
+		Data:       copyValue(r.Data),
+		params:     r.params,
+		scratchpad: r.scratchpad,
+	}
+	if r.KeyVal != nil {
+		c.KeyVal = copyValue(r.KeyVal).(map[string]interface{})
+	}
+	return c
+}
+
+func copyValue(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return copyReflect(reflect.ValueOf(v)).Interface()
+}
+
+// copyReflect copies maps and slices, and the maps and slices they contain
+func copyReflect(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		deep := containsReferences(v.Type().Elem())
+		iter := v.MapRange()
+		for iter.Next() {
+			if deep {
+				c.SetMapIndex(iter.Key(), copyReflect(iter.Value()))
+			} else {
+				c.SetMapIndex(iter.Key(), iter.Value())
+			}
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		if !containsReferences(v.Type().Elem()) {
+			// slices of scalars, such as []byte, are copied at once
+			reflect.Copy(c, v)
+			return c
+		}
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyReflect(v.Index(i)))
+		}
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(copyReflect(v.Elem()))
+		return c
+	}
+	return v
+}
+
+// containsReferences returns true if values of the type may hold maps or slices copied by copyReflect
+func containsReferences(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Interface:
+		return true
+	}
+	return false
+}
@@ -9,6 +9,7 @@ package pipeline
 
 // Modified the errgroup package to return type Result
 import (
+	"reflect"
 	"sync"
 
 	"context"
@@ -28,7 +29,7 @@ type group struct {
 	sync.RWMutex
 }
 
-func (g *group) mergeResult(r *Result) {
+func (g *group) mergeResult(name string, passed map[string]interface{}, r *Result) {
 	g.Lock()
 	defer g.Unlock()
 
@@ -54,9 +55,14 @@ func (g *group) mergeResult(r *Result) {
 		}
 	}
 
-	// merge keyval result
+	// merge keyval result, the keys set by the step are also namespaced by the name of the step as name.key.
+	// Keys passed through from the request of the step aren't namespaced
 	for k, v := range r.KeyVal {
 		g.result.KeyVal[k] = v
+		if p, ok := passed[k]; ok && reflect.DeepEqual(p, v) {
+			continue
+		}
+		g.result.KeyVal[name+"."+k] = v
 	}
 }
 
@@ -84,13 +90,19 @@ func (g *group) wait() *Result {
 //
 // The first call to return a non-nil error cancels the group; its error will be
 // returned by Wait. Result.KeyVal from each step are merged together in a single result and returned.
-func (g *group) run(f func() *Result) {
+// request is the KeyVal the step is run with
+func (g *group) run(name string, request map[string]interface{}, f func() *Result) {
+	passed := make(map[string]interface{}, len(request))
+	for k, v := range request {
+		passed[k] = v
+	}
+
 	g.wg.Add(1)
 	go func() {
 		defer g.wg.Done()
 		result := f()
-		g.mergeResult(result)
-		if result.Error != nil {
+		g.mergeResult(name, passed, result)
+		if result != nil && result.Error != nil {
 			g.errOnce.Do(func() {
 				if g.cancel != nil {
 					g.cancel()
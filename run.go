@@ -0,0 +1,294 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCancelled is the cause of the cancellation of a pipeline with Cancel, CancelStage or CancelStep.
+// It is distinct from the failure of a step, use errors.Is(result.Error, ErrCancelled) to tell them apart
+var ErrCancelled = errors.New("cancelled")
+
+// ErrCancelTimeout is the cancel error of a step which didn't return within the cancel grace period after
+// it was cancelled. The stage abandons the step, whose goroutine is leaked until Exec returns
+var ErrCancelTimeout = errors.New("cancel-timeout")
+
+// ErrPauseTimeout is the reason of the cancellation of a pipeline which wasn't resumed within its PauseTimeout
+var ErrPauseTimeout = errors.New("pause timeout")
+
+// CancelledError is returned by Run when the pipeline, one of its stages or one of its steps was cancelled
+type CancelledError struct {
+	// Stage running when the pipeline was cancelled
+	Stage string
+	// Step is set if only the step was cancelled with CancelStep
+	Step string
+	// CancelErrors are the errors returned by Step.Cancel
+	CancelErrors []error
+	// Err is the reason of a cancellation which wasn't requested with Cancel, such as ErrPauseTimeout
+	Err error
+}
+
+func (e *CancelledError) Error() string {
+	msg := "pipeline cancelled"
+	if e.Step != "" {
+		msg = fmt.Sprintf("step %s of stage %s cancelled", e.Step, e.Stage)
+	} else if e.Stage != "" {
+		msg = fmt.Sprintf("pipeline cancelled in stage %s", e.Stage)
+	}
+
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	if len(e.CancelErrors) > 0 {
+		msg += fmt.Sprintf(", cancel errors: %v", e.CancelErrors)
+	}
+	return msg
+}
+
+// Unwrap returns ErrCancelled and the reason of the cancellation
+func (e *CancelledError) Unwrap() []error {
+	if e.Err != nil {
+		return []error{ErrCancelled, e.Err}
+	}
+	return []error{ErrCancelled}
+}
+
+// runState is the state of a pipeline run shared by its stages
+type runState struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	// cancel funcs of the running stages by name and of the running steps by stage/step
+	stages       map[string]context.CancelCauseFunc
+	steps        map[string]context.CancelCauseFunc
+	cancelErrors []error
+	// cancelGrace is the pipeline's CancelGracePeriod
+	cancelGrace time.Duration
+	// resumed is closed when a paused run is resumed, pauseTimer cancels the run after the pipeline's PauseTimeout
+	paused      bool
+	resumed     chan struct{}
+	pauseTimer  *time.Timer
+	pausedAt    time.Time
+	pausedTotal time.Duration
+	// completedSteps are the completed step executions to compensate if the run fails, stage is the index
+	// of the running stage of the pipeline
+	completedSteps []completedStep
+	stage          int
+	// cache is the pipeline's Cache, cacheTTL its CacheTTL
+	cache    CacheStore
+	cacheTTL time.Duration
+	// artifacts is the artifact store of the run
+	artifacts *runArtifacts
+	// locks is the pipeline's LockBackend
+	locks LockBackend
+	sync.Mutex
+}
+
+func newRunState(cancelGrace time.Duration) *runState {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	return &runState{
+		ctx:         ctx,
+		cancel:      cancel,
+		cancelGrace: cancelGrace,
+		stages:      make(map[string]context.CancelCauseFunc),
+		steps:       make(map[string]context.CancelCauseFunc),
+	}
+}
+
+// register the cancel func of a running stage or step, returning a func to unregister it
+func (rs *runState) register(running map[string]context.CancelCauseFunc, key string, cancel context.CancelCauseFunc) func() {
+	rs.Lock()
+	defer rs.Unlock()
+	running[key] = cancel
+	return func() {
+		rs.Lock()
+		defer rs.Unlock()
+		delete(running, key)
+	}
+}
+
+func (rs *runState) cancelRunning(running map[string]context.CancelCauseFunc, key string, cause error) bool {
+	rs.Lock()
+	defer rs.Unlock()
+	cancel, ok := running[key]
+	if ok {
+		cancel(cause)
+	}
+	return ok
+}
+
+func (rs *runState) addCancelError(err error) {
+	rs.Lock()
+	defer rs.Unlock()
+	rs.cancelErrors = append(rs.cancelErrors, err)
+}
+
+// cancelled returns the CancelledError for a run whose stage returned a cancellation error
+func (rs *runState) cancelled(stage string, err error) *CancelledError {
+	cerr := &CancelledError{Stage: stage}
+	var cause *CancelledError
+	if errors.As(err, &cause) {
+		if cause.Stage != "" {
+			cerr.Stage, cerr.Step = cause.Stage, cause.Step
+		}
+		cerr.Err = cause.Err
+	}
+
+	rs.Lock()
+	defer rs.Unlock()
+	cerr.CancelErrors = append(cerr.CancelErrors, rs.cancelErrors...)
+	return cerr
+}
+
+func (rs *runState) pause(timeout time.Duration) bool {
+	rs.Lock()
+	defer rs.Unlock()
+	if rs.paused {
+		return false
+	}
+
+	rs.paused = true
+	rs.resumed = make(chan struct{})
+	rs.pausedAt = time.Now()
+	if timeout > 0 {
+		rs.pauseTimer = time.AfterFunc(timeout, func() {
+			rs.cancel(&CancelledError{Err: ErrPauseTimeout})
+		})
+	}
+	return true
+}
+
+func (rs *runState) resume() bool {
+	rs.Lock()
+	defer rs.Unlock()
+	if !rs.paused {
+		return false
+	}
+
+	rs.paused = false
+	rs.pausedTotal += time.Since(rs.pausedAt)
+	if rs.pauseTimer != nil {
+		rs.pauseTimer.Stop()
+		rs.pauseTimer = nil
+	}
+	close(rs.resumed)
+	return true
+}
+
+func (rs *runState) isPaused() bool {
+	rs.Lock()
+	defer rs.Unlock()
+	return rs.paused
+}
+
+// pausedDuration is the time the run has spent paused, including the current pause
+func (rs *runState) pausedDuration() time.Duration {
+	rs.Lock()
+	defer rs.Unlock()
+	if rs.paused {
+		return rs.pausedTotal + time.Since(rs.pausedAt)
+	}
+	return rs.pausedTotal
+}
+
+// waitIfPaused blocks a paused run at a stage or step boundary until it is resumed, returning the cause
+// of the cancellation if ctx is done first
+func (rs *runState) waitIfPaused(ctx context.Context, status func(line string)) error {
+	rs.Lock()
+	paused, resumed := rs.paused, rs.resumed
+	rs.Unlock()
+	if !paused {
+		return nil
+	}
+
+	status("paused")
+	select {
+	case <-resumed:
+		status("resumed")
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// Cancel the pipeline from any goroutine. The running steps are cancelled with Step.Cancel, the remaining
+// stages are skipped and Run returns a *CancelledError
+func (p *Pipeline) Cancel() error {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+	if p.run == nil {
+		return fmt.Errorf("pipeline %s is not running", p.Name)
+	}
+	p.run.cancel(ErrCancelled)
+	return nil
+}
+
+// CancelStage cancels the running steps of the stage. The remaining stages are skipped and Run returns a *CancelledError
+func (p *Pipeline) CancelStage(stage string) error {
+	rs := p.running()
+	if rs == nil {
+		return fmt.Errorf("pipeline %s is not running", p.Name)
+	}
+
+	if !rs.cancelRunning(rs.stages, stage, &CancelledError{Stage: stage}) {
+		return fmt.Errorf("stage %s is not running", stage)
+	}
+	return nil
+}
+
+// CancelStep cancels a running step, identified by its name within the stage. The step fails with a *CancelledError,
+// which also cancels the other steps of a concurrent stage in strict mode
+func (p *Pipeline) CancelStep(stage string, step string) error {
+	rs := p.running()
+	if rs == nil {
+		return fmt.Errorf("pipeline %s is not running", p.Name)
+	}
+
+	if !rs.cancelRunning(rs.steps, stage+"/"+step, &CancelledError{Stage: stage, Step: step}) {
+		return fmt.Errorf("step %s of stage %s is not running", step, stage)
+	}
+	return nil
+}
+
+// Pause the running pipeline at the next stage boundary, or step boundary in sequential stages, until Resume
+// is called. Running steps aren't interrupted. If PauseTimeout is set the run is cancelled with ErrPauseTimeout
+// if it isn't resumed within PauseTimeout. Paused time doesn't count towards the duration and progress of the pipeline
+func (p *Pipeline) Pause() error {
+	rs := p.running()
+	if rs == nil {
+		return fmt.Errorf("pipeline %s is not running", p.Name)
+	}
+
+	if !rs.pause(p.PauseTimeout) {
+		return fmt.Errorf("pipeline %s is already paused", p.Name)
+	}
+	p.status("pausing at the next stage or step")
+	return nil
+}
+
+// Resume a paused pipeline
+func (p *Pipeline) Resume() error {
+	rs := p.running()
+	if rs == nil {
+		return fmt.Errorf("pipeline %s is not running", p.Name)
+	}
+
+	if !rs.resume() {
+		return fmt.Errorf("pipeline %s is not paused", p.Name)
+	}
+	return nil
+}
+
+// Paused returns true if the running pipeline is paused
+func (p *Pipeline) Paused() bool {
+	rs := p.running()
+	return rs != nil && rs.isPaused()
+}
+
+func (p *Pipeline) running() *runState {
+	p.runMu.Lock()
+	defer p.runMu.Unlock()
+	return p.run
+}
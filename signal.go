@@ -0,0 +1,67 @@
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// exit is replaced in tests
+var exit = os.Exit
+
+// HandleSignals cancels the pipeline when the process receives SIGINT or SIGTERM, or the given signals.
+// On the first signal the running steps are cancelled with Step.Cancel and the remaining stages are
+// skipped. If Run hasn't returned after gracePeriod, or on a second signal, the process exits immediately.
+// A zero gracePeriod waits for the pipeline's CancelGracePeriod, or DefaultCancelGracePeriod if it is zero too.
+// The process also exits immediately on a signal received while the pipeline isn't running.
+// Call the returned stop func once Run has returned to restore the default signal handling
+func HandleSignals(p *Pipeline, gracePeriod time.Duration, signals ...os.Signal) (stop func()) {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	sigChan := make(chan os.Signal, 2)
+	done := make(chan struct{})
+	signal.Notify(sigChan, signals...)
+
+	go func() {
+		select {
+		case sig := <-sigChan:
+			if gracePeriod <= 0 {
+				gracePeriod = p.CancelGracePeriod
+			}
+			if gracePeriod <= 0 {
+				gracePeriod = DefaultCancelGracePeriod
+			}
+			if err := p.Cancel(); err != nil {
+				p.status(fmt.Sprintf("received %s, exiting: %v", sig, err))
+				exit(1)
+				return
+			}
+			p.status(fmt.Sprintf("received %s, cancelling. Waiting %s for the running steps to stop", sig, gracePeriod))
+		case <-done:
+			return
+		}
+
+		select {
+		case sig := <-sigChan:
+			p.status(fmt.Sprintf("received %s again, exiting", sig))
+			exit(1)
+		case <-time.After(gracePeriod):
+			p.status(fmt.Sprintf("running steps didn't stop after %s, exiting", gracePeriod))
+			exit(1)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigChan)
+		select {
+		case <-done:
+		default:
+			close(done)
+		}
+	}
+}
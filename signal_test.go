@@ -0,0 +1,109 @@
+//go:build !windows
+// +build !windows
+
+package pipeline
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHandleSignals(t *testing.T) {
+	exited := make(chan int, 1)
+	exit = func(code int) { exited <- code }
+	defer func() { exit = os.Exit }()
+
+	cancelled := make(chan struct{})
+	stage := NewStage("wait", false, false)
+	stage.AddStep(NewStep("wait", func(ctx context.Context, request *Request) *Result {
+		<-ctx.Done()
+		close(cancelled)
+		return &Result{Error: ctx.Err()}
+	}))
+	skipped := NewStage("skipped", false, false)
+	skipped.AddStep(NewStep("skipped", func(ctx context.Context, request *Request) *Result {
+		t.Error("stage after the cancelled stage was run")
+		return nil
+	}))
+
+	testpipe := New("TestHandleSignals", 100)
+	testpipe.AddStage(stage, skipped)
+	subscribe(testpipe)
+
+	stop := HandleSignals(testpipe, time.Second, syscall.SIGUSR1)
+	defer stop()
+
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+	}()
+
+	if result := testpipe.Run(); result.Error == nil {
+		t.Fatal("expected the cancelled pipeline to fail")
+	}
+	<-cancelled
+	stop()
+
+	select {
+	case code := <-exited:
+		t.Fatalf("unexpected exit %d", code)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestHandleSignalsNotRunning(t *testing.T) {
+	exited := make(chan int, 1)
+	exit = func(code int) { exited <- code }
+	defer func() { exit = os.Exit }()
+
+	testpipe := New("TestHandleSignalsNotRunning", 100)
+	stop := HandleSignals(testpipe, time.Second, syscall.SIGUSR1)
+	defer stop()
+	syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("expected a signal received while the pipeline isn't running to exit")
+	}
+}
+
+func TestHandleSignalsZeroGracePeriod(t *testing.T) {
+	exited := make(chan int, 1)
+	exit = func(code int) { exited <- code }
+	defer func() { exit = os.Exit }()
+
+	stage := NewStage("slow", false, false)
+	stage.AddStep(NewStep("slow", func(ctx context.Context, request *Request) *Result {
+		<-ctx.Done()
+		time.Sleep(time.Millisecond * 200)
+		return &Result{Error: ctx.Err()}
+	}))
+
+	testpipe := New("TestHandleSignalsZeroGracePeriod", 100)
+	testpipe.CancelGracePeriod = time.Second
+	testpipe.AddStage(stage)
+	subscribe(testpipe)
+
+	stop := HandleSignals(testpipe, 0, syscall.SIGUSR1)
+	defer stop()
+
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+	}()
+
+	if result := testpipe.Run(); result.Error == nil {
+		t.Fatal("expected the cancelled pipeline to fail")
+	}
+	stop()
+
+	select {
+	case code := <-exited:
+		t.Fatalf("expected a zero grace period to wait for the pipeline's CancelGracePeriod, exited %d", code)
+	default:
+	}
+}
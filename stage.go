@@ -2,23 +2,54 @@ package pipeline
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/fatih/color"
 )
 
 // Stage is a collection of steps executed concurrently or sequentially
-//    concurrent: run the steps concurrently
+//    concurrent: run the steps concurrently. Each step receives its own copy of the request, copying the maps
+//    and slices of Data and KeyVal but not the values behind pointers. Use Request.Scratchpad to share values
+//    between concurrent steps
 //
 //    disableStrictMode: In strict mode if a single step fails, all the other concurrent steps are cancelled.
 //    Step.Cancel will be invoked for cancellation of the step. Set disableStrictMode to true to disable strict mode
+//
+//    maxConcurrency: the maximum number of steps of a concurrent stage run at once, unlimited if zero
+//
+//    when: the stage is only run if When returns true for the request it would be run with, else it is skipped
+//    and the request is passed on to the next stage
+//
+//    locks: the named locks held while the stage runs, shared with the stages and steps of all the pipelines
+//    using the same LockBackend
+//
+//    cancelGracePeriod: the time a cancelled step is given to return before it is abandoned, the pipeline's
+//    CancelGracePeriod if zero
 type Stage struct {
-	Name              string `json:"name"`
-	Steps             []Step `json:"steps"`
-	Concurrent        bool   `json:"concurrent"`
-	DisableStrictMode bool   `json:"disableStrictMode"`
+	Name              string                      `json:"name"`
+	Steps             []Step                      `json:"steps"`
+	Concurrent        bool                        `json:"concurrent"`
+	DisableStrictMode bool                        `json:"disableStrictMode"`
+	CancelGracePeriod time.Duration               `json:"cancelGracePeriod"`
+	MaxConcurrency    int                         `json:"maxConcurrency"`
+	Locks             []Lock                      `json:"locks"`
+	When              func(request *Request) bool `json:"-"`
 	index             int
 	pipelineKey       string
+	// nameTemplate is the name with ${...} references, resolved against the request when the stage is run
+	nameTemplate string
+	// stepNames are the names given with AddNamedStep, indexed as Steps
+	stepNames []string
+	// approval is the gate of an approval stage
+	approval *approvalGate
+	// generate returns the steps of a generator stage when it is run
+	generate func(request *Request) ([]Step, error)
 }
 
 // NewStage returns a new stage
@@ -34,71 +65,196 @@ func (st *Stage) AddStep(step ...Step) {
 	st.Steps = append(st.Steps, step...)
 }
 
-// Run the stage execution sequentially
-func (st *Stage) run(request *Request) *Result {
-	if len(st.Steps) == 0 {
+// AddNamedStep adds a new step to the stage with a name unique within the stage.
+// The name identifies the step in the pipeline output, errors and the namespaced keys of Result.KeyVal
+func (st *Stage) AddNamedStep(name string, step Step) {
+	for len(st.stepNames) < len(st.Steps) {
+		st.stepNames = append(st.stepNames, "")
+	}
+	st.stepNames = append(st.stepNames[:len(st.Steps)], name)
+	st.Steps = append(st.Steps, step)
+}
+
+// stepIDs returns the names identifying the steps of the stage: the name given with AddNamedStep,
+// the name of a Named step or else the type name of the step. Type names shared by several steps
+// are suffixed with the index of the step. An error is returned if a name is given to more than one step
+func (st *Stage) stepIDs() ([]string, error) {
+	ids := make([]string, len(st.Steps))
+	explicit := make(map[string][]int)
+	typeCount := make(map[string]int)
+	for j, step := range st.Steps {
+		if j < len(st.stepNames) && st.stepNames[j] != "" {
+			ids[j] = st.stepNames[j]
+		} else if named, ok := step.(Named); ok && named.StepName() != "" {
+			ids[j] = named.StepName()
+		}
+
+		if ids[j] != "" {
+			explicit[ids[j]] = append(explicit[ids[j]], j)
+			continue
+		}
+		typeCount[stepTypeName(step)]++
+	}
+
+	for j, step := range st.Steps {
+		if ids[j] != "" {
+			continue
+		}
+		ids[j] = stepTypeName(step)
+		if _, ok := explicit[ids[j]]; ok || typeCount[ids[j]] > 1 {
+			ids[j] += "#" + strconv.Itoa(j)
+		}
+	}
+
+	var duplicates []string
+	for name, indexes := range explicit {
+		if len(indexes) > 1 {
+			duplicates = append(duplicates, name)
+		}
+	}
+	if len(duplicates) > 0 {
+		sort.Strings(duplicates)
+		return ids, fmt.Errorf("duplicate step names in stage %s: %s", st.Name, strings.Join(duplicates, ", "))
+	}
+
+	return ids, nil
+}
+
+// stepTypeName is the type name of the step, or the step type of a step created from a pipeline definition
+func stepTypeName(step Step) string {
+	if step == nil {
+		return "<nil>"
+	}
+	if ds, ok := step.(*definedStep); ok {
+		return ds.typeName
+	}
+	return reflect.TypeOf(step).String()
+}
+
+// Run the stage execution sequentially. The running steps are cancelled when ctx is done
+func (st *Stage) run(rs *runState, parent context.Context, request *Request) *Result {
+	if len(st.Steps) == 0 && st.generate == nil {
 		return &Result{Error: fmt.Errorf("No steps to be executed")}
 	}
+
+	if st.nameTemplate != "" {
+		named, err := st.named(request)
+		if err != nil {
+			return &Result{Error: err}
+		}
+		return named.run(rs, parent, request)
+	}
+
+	if st.When != nil {
+		run, err := evalWhen(st.When, request)
+		if err != nil {
+			return &Result{Error: fmt.Errorf("stage %s: %w", st.Name, err)}
+		}
+		if !run {
+			st.status("skipped")
+			return &Result{Data: request.Data, KeyVal: request.KeyVal}
+		}
+	}
+
+	if len(st.Locks) > 0 {
+		locked, release, err := acquireLocks(parent, rs.lockBackend(), st.Locks, st.status)
+		if err != nil {
+			return &Result{Error: fmt.Errorf("stage %s: %w", st.Name, ctxErrorOr(parent, err))}
+		}
+		defer release()
+		parent = locked
+	}
+
+	if st.generate != nil {
+		return st.runGenerated(rs, parent, request)
+	}
+
+	ids, err := st.stepIDs()
+	if err != nil {
+		return &Result{Error: err}
+	}
+	steps := st.bindSteps(rs, ids)
+
+	ctx, cancel := context.WithCancelCause(parent)
+	defer cancel(nil)
+	defer rs.register(rs.stages, st.Name, cancel)()
+
 	st.status("begin")
 	defer st.status("end")
 
 	if st.Concurrent {
 		st.status("is concurrent")
-		g, ctx := withContext(context.Background())
-		for _, step := range st.Steps {
+		g, groupCtx := withContext(ctx)
+		var slots chan struct{}
+		if st.MaxConcurrency > 0 {
+			slots = make(chan struct{}, st.MaxConcurrency)
+		}
+		for j, step := range steps {
+			step, id := step, ids[j]
+			// each concurrent step gets its own copy of the request
+			request := request.isolate()
+			skipped, err := skip(step, request)
+			if err != nil {
+				g.run(id, nil, func() *Result { return st.stepResult(id, &Result{Error: err}) })
+				continue
+			}
+			if skipped {
+				continue
+			}
 			step.Status("begin")
-			g.run(func() *Result {
+			g.run(id, request.KeyVal, func() *Result {
 
 				defer step.Status("end")
-				//disables strict mode. g.run will wait for all steps to finish
+				//disables strict mode. g.run will wait for all steps to finish, unless the pipeline is cancelled
+				stepCtx := groupCtx
 				if st.DisableStrictMode {
-					return step.Exec(request)
+					stepCtx = ctx
 				}
 
-				resultChan := make(chan *Result, 1)
-
-				go func() {
-					result := step.Exec(request)
-					if result == nil {
-						result = &Result{}
+				if slots != nil {
+					select {
+					case slots <- struct{}{}:
+						defer func() { <-slots }()
+					case <-stepCtx.Done():
+						return st.stepResult(id, &Result{Error: ctxError(stepCtx)})
 					}
-					resultChan <- result
-				}()
-
-				select {
-				case <-ctx.Done():
-
-					if err := step.Cancel(); err != nil {
-						st.status("Error Cancelling Step " + step.getCtx().name)
-					}
-
-					<-resultChan
-					return &Result{Error: ctx.Err()}
-
-				case result := <-resultChan:
-					if result == nil {
-						result = &Result{}
-					}
-					return result
 				}
 
+				return st.stepResult(id, st.runStep(rs, stepCtx, id, step, request))
 			})
 		}
 
-		if result := g.wait(); result != nil && result.Error != nil {
+		result := g.wait()
+		if result.Error != nil {
 			st.status(" >>>failed !!! ")
-			return result
 		}
+		return result
 
 	} else {
 		st.status("is not concurrent")
 		res := &Result{}
-		for _, step := range st.Steps {
+		for j, step := range steps {
+			if j > 0 {
+				if err := rs.waitIfPaused(ctx, step.Status); err != nil {
+					return &Result{Error: err}
+				}
+			}
+
+			skipped, err := skip(step, request)
+			if err != nil {
+				step.Status(">>>failed !!!")
+				return st.stepResult(ids[j], &Result{Error: err})
+			}
+			if skipped {
+				res = &Result{Data: request.Data, KeyVal: request.KeyVal}
+				continue
+			}
+
 			step.Status("begin")
-			res = step.Exec(request)
+			res = st.runStep(rs, ctx, ids[j], step, request)
 			if res != nil && res.Error != nil {
 				step.Status(">>>failed !!!")
-				return res
+				return st.stepResult(ids[j], res)
 			}
 
 			if res == nil {
@@ -113,8 +269,204 @@ func (st *Stage) run(request *Request) *Result {
 		}
 		return res
 	}
+}
+
+// named returns the stage as run with the request. A stage whose name references the request is run as a copy
+// named after the request, so that the stage shared by the runs of the pipeline isn't renamed
+func (st *Stage) named(request *Request) (*Stage, error) {
+	if st.nameTemplate == "" {
+		return st, nil
+	}
+
+	name, err := interpolate(st.nameTemplate, request)
+	if err != nil {
+		return nil, fmt.Errorf("stage %s: %v", st.nameTemplate, err)
+	}
+	named := *st
+	named.Name = fmt.Sprint(name)
+	named.nameTemplate = ""
+	return &named, nil
+}
+
+// runStep executes the step, cancelling it with Step.Cancel if ctx is done, or the step is cancelled
+// with Pipeline.CancelStep, before it returns
+func (st *Stage) runStep(rs *runState, parent context.Context, id string, step Step, request *Request) *Result {
+	ctx, cancel := context.WithCancelCause(parent)
+	defer cancel(nil)
+	defer rs.register(rs.steps, st.Name+"/"+id, cancel)()
+
+	if p, ok := step.(preparer); ok {
+		if err := prepareStep(p, request); err != nil {
+			return &Result{Error: err}
+		}
+	}
+
+	if locks := requiredLocks(step); len(locks) > 0 {
+		locked, release, err := acquireLocks(ctx, rs.lockBackend(), locks, step.Status)
+		if err != nil {
+			return &Result{Error: ctxErrorOr(ctx, err)}
+		}
+		defer release()
+		ctx = locked
+	}
+	// sub-pipelines run by the step hold the locks of the step and its stage
+	if sc := step.getCtx(); sc != nil {
+		sc.heldLocks = heldLocks(ctx)
+	}
+
+	cacheKey, err := rs.cacheKey(st, id, step, request)
+	if err != nil {
+		return &Result{Error: fmt.Errorf("cache key: %w", err)}
+	}
+	if cacheKey != "" {
+		if result, ok := rs.cached(step, cacheKey); ok {
+			step.Status("cached")
+			return result
+		}
+	}
+
+	// the request of a sequential stage is updated by the next steps, keep the request the step is executed with
+	executed := *request
+	resultChan := make(chan *Result, 1)
+
+	go func() {
+		resultChan <- execStep(step, request)
+	}()
+
+	select {
+	case <-ctx.Done():
+
+		if err := cancelStep(step); err != nil {
+			st.status("Error Cancelling Step " + step.getCtx().name)
+			rs.addCancelError(&StepError{Stage: st.Name, Step: id, Err: err})
+		}
+
+		grace := st.CancelGracePeriod
+		if grace <= 0 {
+			grace = rs.cancelGrace
+		}
+
+		select {
+		case <-resultChan:
+		case <-time.After(grace):
+			// the step ignored the cancellation, abandon it so that it can't wedge the stage
+			step.Status("cancel-timeout")
+			st.status(fmt.Sprintf("abandoning step %s after %s, its goroutine is leaked until Exec returns", id, grace))
+			rs.addCancelError(&StepError{Stage: st.Name, Step: id, Err: ErrCancelTimeout})
+		}
+
+		return &Result{Error: ctxError(ctx)}
+
+	case result := <-resultChan:
+		if result == nil || result.Error == nil {
+			rs.completed(st.Name, id, step, &executed, result)
+			if cacheKey != "" {
+				rs.cacheResult(step, cacheKey, result)
+			}
+		}
+		return result
+	}
+}
+
+// ctxError is the error of a step whose context is done. Cancellations requested with Cancel, CancelStage or
+// CancelStep are told apart from failures
+func ctxError(ctx context.Context) error {
+	if cause := context.Cause(ctx); errors.Is(cause, ErrCancelled) {
+		return cause
+	}
+	return ctx.Err()
+}
+
+// ctxErrorOr returns the error of ctx if it is done, else err
+func ctxErrorOr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctxError(ctx)
+	}
+	return err
+}
+
+// execStep executes the step, returning a panic in the step as a failed result
+func execStep(step Step, request *Request) (result *Result) {
+	var err error
+	defer func() {
+		if panicErr, ok := err.(*PanicError); ok {
+			step.Status(fmt.Sprintf("panic: %v\n%s", panicErr.Value, panicErr.Stack))
+			result = &Result{Error: err}
+		}
+	}()
+	defer recovered(&err)
+
+	return step.Exec(request)
+}
+
+// preparer is implemented by steps of this package which create the step they execute from the request
+type preparer interface {
+	prepare(request *Request) error
+}
+
+// prepareStep prepares the step, returning a panic in the step factory as an error
+func prepareStep(p preparer, request *Request) (err error) {
+	defer recovered(&err)
+	return p.prepare(request)
+}
+
+// cancelStep cancels the step, returning a panic in Step.Cancel as an error
+func cancelStep(step Step) (err error) {
+	defer recovered(&err)
+	return step.Cancel()
+}
+
+// skip returns true if the step is Conditional and its condition doesn't hold for the request
+func skip(step Step, request *Request) (bool, error) {
+	c, ok := step.(Conditional)
+	if !ok {
+		return false, nil
+	}
+
+	run, err := evalWhen(c.When, request)
+	if err != nil || run {
+		return false, err
+	}
+	step.Status("skipped")
+	return true, nil
+}
+
+// evalWhen evaluates the condition of a stage or step, returning a panic in the condition as an error
+func evalWhen(when func(request *Request) bool, request *Request) (run bool, err error) {
+	defer recovered(&err)
+	return when(request), nil
+}
 
-	return &Result{}
+// bindSteps returns the steps to be executed by this run of the stage, each bound to a new step context
+func (st *Stage) bindSteps(rs *runState, ids []string) []Step {
+	steps := make([]Step, len(st.Steps))
+	for j, step := range st.Steps {
+		ctx := &stepContextVal{
+			name:        st.pipelineKey + "." + st.Name + "." + ids[j],
+			id:          ids[j],
+			stage:       st.Name,
+			run:         rs,
+			pipelineKey: st.pipelineKey,
+			concurrent:  st.Concurrent,
+			index:       j,
+		}
+		steps[j] = bindStep(step, ctx)
+	}
+	return steps
+}
+
+// stepResult identifies the error of a failed step with a StepError
+func (st *Stage) stepResult(id string, result *Result) *Result {
+	if result == nil {
+		return &Result{}
+	}
+
+	if result.Error != nil {
+		if _, ok := result.Error.(*StepError); !ok {
+			result.Error = &StepError{Stage: st.Name, Step: id, Err: result.Error}
+		}
+	}
+	return result
 }
 
 // status writes a line to the out channel
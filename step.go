@@ -2,6 +2,7 @@ package pipeline
 
 import (
 	"fmt"
+	"runtime/debug"
 
 	"github.com/fatih/color"
 )
@@ -19,6 +20,9 @@ type Result struct {
 type Request struct {
 	Data   interface{}
 	KeyVal map[string]interface{}
+	// pipeline parameters, see Request.Param
+	params     map[string]interface{}
+	scratchpad *Scratchpad
 }
 
 // Step is the unit of work which can be concurrently or sequentially staged with other steps
@@ -30,6 +34,61 @@ type Step interface {
 	Cancel() error
 }
 
+// Named is implemented by steps which provide their own name. The name identifies the step within its stage
+// in the pipeline output, errors and the namespaced keys of Result.KeyVal, instead of the type name of the step
+type Named interface {
+	StepName() string
+}
+
+// Conditional is implemented by steps which are only executed when a condition holds. When is evaluated against
+// the request the step would be executed with, the step is skipped if it returns false
+type Conditional interface {
+	When(request *Request) bool
+}
+
+// wrapper is implemented by steps of this package which execute another step, such as the steps of matrix,
+// foreach and loop stages. The locks of the wrapped step are held by the wrapper, and the wrapper is only
+// compensated and cached if the wrapped step is
+type wrapper interface {
+	unwrap() Step
+}
+
+// StepError is the error of a failed step, identifying the step by its stage and name
+type StepError struct {
+	Stage string
+	Step  string
+	Err   error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("stage %s step %s: %v", e.Stage, e.Step, e.Err)
+}
+
+// Unwrap returns the error returned by the step
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// PanicError is the error of a step which panicked
+type PanicError struct {
+	// Value passed to panic
+	Value interface{}
+	// Stack of the goroutine which panicked
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// recovered is deferred by the calls into the code of steps, stages and hooks. It recovers a panic
+// and stores it in err as a PanicError
+func recovered(err *error) {
+	if r := recover(); r != nil {
+		*err = &PanicError{Value: r, Stack: debug.Stack()}
+	}
+}
+
 type out interface {
 	Status(line string)
 	getCtx() *stepContextVal
@@ -38,12 +97,25 @@ type out interface {
 
 type stepContextVal struct {
 	pipelineKey string
-	name        string
-	index       int
-	concurrent  bool
+	// name is pipeline.stage.id
+	name string
+	// id is the name of the step within the stage
+	id         string
+	stage      string
+	index      int
+	concurrent bool
+	// run is the state of the pipeline run executing the step
+	run *runState
+	// heldLocks are the names of the locks held by the step and its stage
+	heldLocks map[string]bool
 }
 
-// StepContext type is embedded in types which need to statisfy the Step interface
+// StepContext type is embedded in types which need to statisfy the Step interface.
+//
+// Each execution of a step runs on a shallow copy of the step with its own StepContext, so that
+// a step added to several stages or pipelines, or executed concurrently, has its output and
+// cancellation attributed to the right execution. Fields set by Exec on the copy are not seen on
+// the step added to the stage. Steps embedding *StepContext instead of StepContext are not copied.
 type StepContext struct {
 	ctx *stepContextVal
 }
@@ -56,10 +128,14 @@ func (sc *StepContext) setCtx(ctx *stepContextVal) {
 	sc.ctx = ctx
 }
 
-// Status is used to log status from a step
+// Status is used to log status from a step. Lines logged outside of an execution of the step are dropped
 func (sc *StepContext) Status(line string) {
-	stepText := fmt.Sprintf("[step-%d]", sc.getCtx().index)
+	ctx := sc.getCtx()
+	if ctx == nil {
+		return
+	}
+	stepText := fmt.Sprintf("[step-%d]", ctx.index)
 	blue := color.New(color.FgBlue).SprintFunc()
-	line = blue(stepText) + "[" + sc.getCtx().name + "]: " + line
-	send(sc.getCtx().pipelineKey, line)
+	line = blue(stepText) + "[" + ctx.name + "]: " + line
+	send(ctx.pipelineKey, line)
 }
@@ -0,0 +1,42 @@
+package pipeline
+
+import (
+	"reflect"
+)
+
+// cloner is implemented by steps of this package which copy their configuration but not their run state
+type cloner interface {
+	cloneStep() Step
+}
+
+// bindStep returns a copy of the step bound to the step context of an execution.
+// Steps which aren't a pointer to a struct, or which share their StepContext between copies, are bound in place
+func bindStep(step Step, ctx *stepContextVal) Step {
+	if c, ok := step.(cloner); ok {
+		clone := c.cloneStep()
+		clone.setCtx(ctx)
+		return clone
+	}
+
+	v := reflect.ValueOf(step)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		step.setCtx(ctx)
+		return step
+	}
+
+	copied := reflect.New(v.Elem().Type())
+	copied.Elem().Set(v.Elem())
+	clone, ok := copied.Interface().(Step)
+	if !ok {
+		step.setCtx(ctx)
+		return step
+	}
+
+	clone.setCtx(ctx)
+	if step.getCtx() == ctx {
+		// the copy shares an embedded *StepContext with the step
+		return step
+	}
+
+	return clone
+}
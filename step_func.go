@@ -0,0 +1,103 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+)
+
+// StepFunc is a step created from a plain function with NewStep
+type StepFunc struct {
+	StepContext
+	name     string
+	fn       func(ctx context.Context, request *Request) *Result
+	onCancel func() error
+	when     func(request *Request) bool
+	// compensate is the OnCompensate hook
+	compensate func(ctx context.Context, request *Request, result *Result) error
+	// cacheKey is the function set by CachedBy
+	cacheKey func(request *Request) (string, error)
+	locks    []Lock
+	cancel   context.CancelFunc
+	// cancelled is set when Cancel is invoked before fn is started
+	cancelled bool
+	sync.Mutex
+}
+
+// NewStep returns a step which executes fn. The name of the step is used in the pipeline output
+// instead of its type name, and fn receives a context which is cancelled when the step is cancelled
+func NewStep(name string, fn func(ctx context.Context, request *Request) *Result) *StepFunc {
+	return &StepFunc{name: name, fn: fn}
+}
+
+// StepName returns the name of the step
+func (s *StepFunc) StepName() string {
+	return s.name
+}
+
+// OnCancel sets a hook invoked when the step is cancelled, after the context of fn is cancelled
+func (s *StepFunc) OnCancel(fn func() error) *StepFunc {
+	s.onCancel = fn
+	return s
+}
+
+// OnlyWhen sets a condition evaluated against the request before the step is executed, the step is skipped if it returns false
+func (s *StepFunc) OnlyWhen(fn func(request *Request) bool) *StepFunc {
+	s.when = fn
+	return s
+}
+
+// When implements Conditional
+func (s *StepFunc) When(request *Request) bool {
+	return s.when == nil || s.when(request)
+}
+
+func (s *StepFunc) cloneStep() Step {
+	return &StepFunc{name: s.name, fn: s.fn, onCancel: s.onCancel, when: s.when, compensate: s.compensate, cacheKey: s.cacheKey, locks: s.locks}
+}
+
+// Exec invokes the function of the step
+func (s *StepFunc) Exec(request *Request) *Result {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), stepFuncKey{}, s))
+	defer cancel()
+
+	s.Lock()
+	s.cancel = cancel
+	if s.cancelled {
+		s.cancelled = false
+		cancel()
+	}
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		s.cancel = nil
+		s.Unlock()
+	}()
+
+	return s.fn(ctx, request)
+}
+
+// Cancel cancels the context of the running function and invokes the OnCancel hook
+func (s *StepFunc) Cancel() error {
+	s.Lock()
+	if s.cancel != nil {
+		s.cancel()
+	} else {
+		s.cancelled = true
+	}
+	s.Unlock()
+
+	if s.onCancel != nil {
+		return s.onCancel()
+	}
+	return nil
+}
+
+type stepFuncKey struct{}
+
+// StepStatus logs status from the function of a StepFunc using the context it was invoked with
+func StepStatus(ctx context.Context, line string) {
+	if s, ok := ctx.Value(stepFuncKey{}).(*StepFunc); ok {
+		s.Status(line)
+	}
+}
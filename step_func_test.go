@@ -0,0 +1,39 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestStepFunc(t *testing.T) {
+	cancelled := make(chan struct{})
+	blocking := NewStep("blocking", func(ctx context.Context, request *Request) *Result {
+		StepStatus(ctx, "waiting for cancel")
+		<-ctx.Done()
+		return &Result{Error: ctx.Err()}
+	}).OnCancel(func() error {
+		close(cancelled)
+		return nil
+	})
+
+	failing := NewStep("failing", func(ctx context.Context, request *Request) *Result {
+		return &Result{Error: errors.New("failed")}
+	})
+
+	p := New("TestStepFunc", 100)
+	stage := NewStage("funcs", true, false)
+	stage.AddStep(blocking, failing)
+	p.AddStage(stage)
+
+	subscribe(p)
+	if result := p.Run(); result.Error == nil {
+		t.Fatal("expected the stage to fail")
+	}
+
+	select {
+	case <-cancelled:
+	default:
+		t.Fatal("cancel hook wasn't invoked")
+	}
+}
@@ -0,0 +1,180 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// Key is a typed key of Request.KeyVal and Result.KeyVal
+type Key[T any] struct {
+	name string
+}
+
+// NewKey returns a typed key for name
+func NewKey[T any](name string) Key[T] {
+	return Key[T]{name: name}
+}
+
+// Name of the key in KeyVal
+func (k Key[T]) Name() string {
+	return k.name
+}
+
+// Get returns the value of the key from the request, false if it isn't set or isn't a T
+func (k Key[T]) Get(request *Request) (T, bool) {
+	return keyVal[T](request.KeyVal, k.name)
+}
+
+// From returns the value of the key from the result, false if it isn't set or isn't a T
+func (k Key[T]) From(result *Result) (T, bool) {
+	return keyVal[T](result.KeyVal, k.name)
+}
+
+// Set stores the value of the key in the result
+func (k Key[T]) Set(result *Result, value T) {
+	if result.KeyVal == nil {
+		result.KeyVal = make(map[string]interface{})
+	}
+	result.KeyVal[k.name] = value
+}
+
+func keyVal[T any](kv map[string]interface{}, name string) (T, bool) {
+	v, ok := kv[name].(T)
+	return v, ok
+}
+
+// DataOf returns Request.Data as a T, false if it isn't a T
+func DataOf[T any](request *Request) (T, bool) {
+	v, ok := request.Data.(T)
+	return v, ok
+}
+
+// typed is implemented by steps with typed Request.Data input and Result.Data output
+type typed interface {
+	dataTypes() (in reflect.Type, out reflect.Type)
+}
+
+// TypedStep is a step with typed input and output Data, created with NewTypedStep.
+// Validate checks that the output of a typed step can be used as the input of the typed step run after it
+type TypedStep[In, Out any] struct {
+	StepFunc
+	typedFn func(ctx context.Context, in In) (Out, error)
+}
+
+// NewTypedStep returns a step which executes fn with Request.Data as In and returns its output as Result.Data.
+// Request.KeyVal is passed on to the next step. The step fails if Request.Data isn't nil and isn't an In
+func NewTypedStep[In, Out any](name string, fn func(ctx context.Context, in In) (Out, error)) *TypedStep[In, Out] {
+	t := &TypedStep[In, Out]{typedFn: fn}
+	t.name = name
+	t.fn = t.exec
+	return t
+}
+
+// OnCancel sets a hook invoked when the step is cancelled, after the context of fn is cancelled
+func (t *TypedStep[In, Out]) OnCancel(fn func() error) *TypedStep[In, Out] {
+	t.onCancel = fn
+	return t
+}
+
+func (t *TypedStep[In, Out]) exec(ctx context.Context, request *Request) *Result {
+	var in In
+	if request.Data != nil {
+		v, ok := request.Data.(In)
+		if !ok {
+			return &Result{Error: fmt.Errorf("step %s expects Data of type %s, got %T", t.name, typeOf[In](), request.Data)}
+		}
+		in = v
+	}
+
+	out, err := t.typedFn(ctx, in)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	return &Result{Data: out, KeyVal: request.KeyVal}
+}
+
+// OnlyWhen sets a condition evaluated against the request before the step is executed, the step is skipped if it returns false
+func (t *TypedStep[In, Out]) OnlyWhen(fn func(request *Request) bool) *TypedStep[In, Out] {
+	t.when = fn
+	return t
+}
+
+// OnCompensate sets a hook invoked to undo the work of the step when the run fails or is cancelled after the step completed
+func (t *TypedStep[In, Out]) OnCompensate(fn func(ctx context.Context, request *Request, result *Result) error) *TypedStep[In, Out] {
+	t.compensate = fn
+	return t
+}
+
+// CachedBy caches the result of the step under the key returned by fn, see Cacheable
+func (t *TypedStep[In, Out]) CachedBy(fn func(request *Request) (string, error)) *TypedStep[In, Out] {
+	t.cacheKey = fn
+	return t
+}
+
+// WithLocks sets locks held while the step runs, see Locked
+func (t *TypedStep[In, Out]) WithLocks(locks ...Lock) *TypedStep[In, Out] {
+	t.locks = locks
+	return t
+}
+
+func (t *TypedStep[In, Out]) cloneStep() Step {
+	c := NewTypedStep(t.name, t.typedFn).OnCancel(t.onCancel)
+	c.when = t.when
+	c.compensate = t.compensate
+	c.cacheKey = t.cacheKey
+	c.locks = t.locks
+	return c
+}
+
+func (t *TypedStep[In, Out]) dataTypes() (reflect.Type, reflect.Type) {
+	return typeOf[In](), typeOf[Out]()
+}
+
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// validateTypes reports typed steps whose input can't be the output of the typed step run before them.
+// Data flows from step to step in sequential stages, and from the last step of a sequential stage to all
+// the steps of the next stage. Untyped steps and concurrent stages break the chain
+func (p *Pipeline) validateTypes(ps *problems) {
+	var prev reflect.Type
+	var prevLoc string
+	check := func(loc string, step Step) {
+		t, ok := step.(typed)
+		if !ok {
+			return
+		}
+		in, _ := t.dataTypes()
+		// the dynamic type of an interface output is only known at run time
+		if prev != nil && prev.Kind() != reflect.Interface && !prev.AssignableTo(in) {
+			ps.add(loc, "expects Data of type %s, %s returns %s", in, prevLoc, prev)
+		}
+	}
+
+	for i, stage := range p.Stages {
+		if stage == nil {
+			prev = nil
+			continue
+		}
+		stageLoc := stageLocation(i, stage.Name)
+		if stage.Concurrent {
+			for j, step := range stage.Steps {
+				check(stageLoc+"."+stepLocation(j, step), step)
+			}
+			prev = nil
+			continue
+		}
+
+		for j, step := range stage.Steps {
+			loc := stageLoc + "." + stepLocation(j, step)
+			check(loc, step)
+			prev = nil
+			if t, ok := step.(typed); ok {
+				_, prev = t.dataTypes()
+				prevLoc = loc
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package pipeline
+
+import (
+	"context"
+	"strconv"
+	"testing"
+)
+
+var lengthKey = NewKey[int]("length")
+
+func TestTypedSteps(t *testing.T) {
+	parse := NewTypedStep("parse", func(ctx context.Context, in string) (int, error) {
+		return strconv.Atoi(in)
+	})
+	double := NewTypedStep("double", func(ctx context.Context, in int) (int, error) {
+		return in * 2, nil
+	})
+	format := NewStep("format", func(ctx context.Context, request *Request) *Result {
+		n, ok := DataOf[int](request)
+		if !ok {
+			t.Errorf("unexpected data %v", request.Data)
+		}
+		result := &Result{Data: strconv.Itoa(n)}
+		lengthKey.Set(result, len(strconv.Itoa(n)))
+		return result
+	})
+
+	seed := NewStep("seed", func(ctx context.Context, request *Request) *Result {
+		return &Result{Data: "21"}
+	})
+
+	testpipe := New("TestTypedSteps", 100)
+	first := NewStage("seed", false, false)
+	first.AddStep(seed)
+	second := NewStage("compute", false, false)
+	second.AddStep(parse, double, format)
+	testpipe.AddStage(first, second)
+
+	if err := testpipe.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	subscribe(testpipe)
+	result := testpipe.Run()
+	if result.Error != nil {
+		t.Fatal(result.Error)
+	}
+
+	if result.Data != "42" {
+		t.Fatalf("unexpected data %v", result.Data)
+	}
+	if length, ok := lengthKey.From(result); !ok || length != 2 {
+		t.Fatalf("unexpected length %v", result.KeyVal)
+	}
+}
+
+func TestTypedStepsMismatch(t *testing.T) {
+	stage := NewStage("mismatch", false, false)
+	stage.AddStep(
+		NewTypedStep("a", func(ctx context.Context, in string) (int, error) { return 0, nil }),
+		NewTypedStep("b", func(ctx context.Context, in string) (string, error) { return in, nil }),
+	)
+	testpipe := New("TestTypedStepsMismatch", 100)
+	testpipe.AddStage(stage)
+
+	verr, ok := testpipe.Validate().(*ValidationError)
+	if !ok || len(verr.Problems) != 1 || verr.Problems[0].Location != "stages[0](mismatch).steps[1](*pipeline.TypedStep[string,string])" {
+		t.Fatalf("expected a type mismatch, got %v", verr)
+	}
+}
@@ -0,0 +1,231 @@
+package pipeline
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Problem is a single issue found while validating a pipeline or a pipeline definition
+type Problem struct {
+	// Location of the problem, e.g. stages[1](deploy).steps[0](*main.deployStep)
+	Location string
+	Message  string
+}
+
+func (pr Problem) String() string {
+	if pr.Location == "" {
+		return pr.Message
+	}
+	return pr.Location + ": " + pr.Message
+}
+
+// ValidationError is returned by Validate and lists all the problems found
+type ValidationError struct {
+	Name     string
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, pr := range e.Problems {
+		lines[i] = pr.String()
+	}
+	return fmt.Sprintf("pipeline %s is invalid: %s", e.Name, strings.Join(lines, "; "))
+}
+
+type problems struct {
+	list []Problem
+}
+
+func (ps *problems) add(location string, format string, args ...interface{}) {
+	ps.list = append(ps.list, Problem{Location: location, Message: fmt.Sprintf(format, args...)})
+}
+
+func (ps *problems) err(name string) error {
+	if len(ps.list) == 0 {
+		return nil
+	}
+	return &ValidationError{Name: name, Problems: ps.list}
+}
+
+// Validate checks the pipeline for problems which would make Run fail or misbehave.
+// All the problems found are returned at once in a *ValidationError
+func (p *Pipeline) Validate() error {
+	ps := &problems{}
+	p.validate(ps)
+	return ps.err(p.Name)
+}
+
+func (p *Pipeline) validate(ps *problems) {
+	if len(p.Stages) == 0 {
+		ps.add("", "no stages to be executed")
+	}
+
+	p.validateParams(ps)
+	p.validateTypes(ps)
+
+	stageNames := make(map[string]int)
+	for i, stage := range p.Stages {
+		if stage == nil {
+			ps.add(fmt.Sprintf("stages[%d]", i), "stage is nil")
+			continue
+		}
+
+		stageLoc := stageLocation(i, stage.Name)
+		if stage.Name == "" {
+			ps.add(stageLoc, "stage name is empty")
+		} else if first, ok := stageNames[stage.Name]; ok {
+			ps.add(stageLoc, "duplicate stage name, also used by stages[%d]", first)
+		} else {
+			stageNames[stage.Name] = i
+		}
+
+		if len(stage.Steps) == 0 && stage.generate == nil {
+			ps.add(stageLoc, "no steps to be executed")
+		}
+
+		if _, err := stage.stepIDs(); err != nil {
+			ps.add(stageLoc, "%v", err)
+		}
+
+		if stage.approval != nil && !stage.approval.defaultAction.valid() {
+			ps.add(stageLoc, "unknown approval default action %q", stage.approval.defaultAction)
+		}
+
+		for j, step := range stage.Steps {
+			stepLoc := stageLoc + "." + stepLocation(j, step)
+			if msg := checkStepContext(step); msg != "" {
+				ps.add(stepLoc, "%s", msg)
+			}
+		}
+	}
+}
+
+// checkStepContext reports steps which can't be given a StepContext by the pipeline
+func checkStepContext(step Step) string {
+	if step == nil {
+		return "step is nil"
+	}
+
+	v := reflect.ValueOf(step)
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return "step is a nil pointer"
+	}
+
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+
+	// a nil *StepContext embedded in the step panics when the pipeline sets the step context
+	scType := reflect.TypeOf(StepContext{})
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Ptr && field.Type.Elem() == scType && v.Field(i).IsNil() {
+			return "embedded *StepContext is nil, embed StepContext by value"
+		}
+	}
+
+	return ""
+}
+
+func stageLocation(i int, name string) string {
+	return fmt.Sprintf("stages[%d](%s)", i, name)
+}
+
+func stepLocation(j int, step Step) string {
+	if step == nil {
+		return fmt.Sprintf("steps[%d]", j)
+	}
+	return fmt.Sprintf("steps[%d](%s)", j, stepTypeName(step))
+}
+
+// Validate checks the definition for problems and that all the step types are known to the registry.
+// The default registry is used if registry is nil. All the problems found are returned at once in a *ValidationError
+func (d *Definition) Validate(registry *Registry) error {
+	ps := &problems{}
+	d.validate(ps, registry)
+	return ps.err(d.Name)
+}
+
+func (d *Definition) validate(ps *problems, registry *Registry) {
+	if registry == nil {
+		registry = defaultRegistry
+	}
+
+	if d.Name == "" {
+		ps.add("name", "pipeline name is empty")
+	}
+
+	if d.OutBufferLen < 0 {
+		ps.add("outBufferLen", "negative output buffer length %d", d.OutBufferLen)
+	}
+
+	if len(d.Stages) == 0 {
+		ps.add("stages", "no stages to be executed")
+	}
+
+	// parameter declarations and references are checked on a pipeline with the same params
+	declared := &Pipeline{Name: d.Name, Params: d.Params}
+	declared.validateParams(ps)
+	checkRefs := func(loc string, v interface{}) {
+		for _, ref := range references(v) {
+			if !strings.HasPrefix(ref, keyValPrefix) && !declared.hasParam(ref) {
+				ps.add(loc, "unresolved reference ${%s}", ref)
+			}
+		}
+	}
+
+	stageNames := make(map[string]int)
+	for i, sd := range d.Stages {
+		checkRefs(stageLocation(i, sd.Name), sd.Name)
+		stageLoc := stageLocation(i, sd.Name)
+		if sd.Name == "" {
+			ps.add(stageLoc, "stage name is empty")
+		} else if first, ok := stageNames[sd.Name]; ok {
+			ps.add(stageLoc, "duplicate stage name, also used by stages[%d]", first)
+		} else {
+			stageNames[sd.Name] = i
+		}
+
+		if len(sd.Steps) == 0 {
+			ps.add(stageLoc, "no steps to be executed")
+		}
+
+		if sd.CancelGracePeriod != "" {
+			if grace, err := time.ParseDuration(sd.CancelGracePeriod); err != nil {
+				ps.add(stageLoc, "cancelGracePeriod: %v", err)
+			} else if grace < 0 {
+				ps.add(stageLoc, "cancelGracePeriod is negative")
+			}
+		}
+
+		stepNames := make(map[string]int)
+		for j, stepDef := range sd.Steps {
+			if stepDef.Name == "" {
+				continue
+			}
+			if first, ok := stepNames[stepDef.Name]; ok {
+				ps.add(fmt.Sprintf("%s.steps[%d](%s)", stageLoc, j, stepDef.Name), "duplicate step name, also used by steps[%d]", first)
+				continue
+			}
+			stepNames[stepDef.Name] = j
+		}
+
+		for j, stepDef := range sd.Steps {
+			stepLoc := fmt.Sprintf("%s.steps[%d](%s)", stageLoc, j, stepDef.Type)
+			if stepDef.Type == "" {
+				ps.add(stepLoc, "step type is empty")
+				continue
+			}
+			if _, ok := registry.Lookup(stepDef.Type); !ok {
+				ps.add(stepLoc, "unknown step type %q", stepDef.Type)
+			}
+			checkRefs(stepLoc+".params", stepDef.Params)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package pipeline
+
+import (
+	"testing"
+)
+
+type nilContextStep struct {
+	*StepContext
+}
+
+func (n nilContextStep) Exec(request *Request) *Result {
+	return nil
+}
+
+func (n nilContextStep) Cancel() error {
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	shared := &TestStep{}
+
+	first := NewStage("first", false, false)
+	first.AddStep(shared)
+	empty := NewStage("empty", true, false)
+	duplicate := NewStage("first", true, false)
+	duplicate.AddStep(shared, nilContextStep{})
+
+	p := New("TestValidate", 10)
+	p.Stages = append(p.Stages, first, empty, duplicate)
+
+	err := p.Validate()
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a *ValidationError, got %v", err)
+	}
+
+	expected := []string{
+		"stages[1](empty)",
+		"stages[2](first)",
+		"stages[2](first).steps[1](pipeline.nilContextStep)",
+	}
+	if len(verr.Problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), verr)
+	}
+	for i, pr := range verr.Problems {
+		if pr.Location != expected[i] {
+			t.Fatalf("expected problem at %s, got %s", expected[i], pr)
+		}
+	}
+
+	valid := New("TestValidateOk", 10)
+	stage := NewStage("stage", false, false)
+	stage.AddStep(&TestStep{}, &TestStep2{})
+	valid.AddStage(stage)
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefinitionValidate(t *testing.T) {
+	def, err := ParseYAML([]byte(`
+name: invalid
+stages:
+  - name: build
+    cancelGracePeriod: soon
+    steps:
+      - type: echo
+      - type: missing
+  - name: build
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = def.Validate(newDefRegistry(t))
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a *ValidationError, got %v", err)
+	}
+	if len(verr.Problems) != 4 {
+		t.Fatalf("expected 4 problems, got %v", verr)
+	}
+}